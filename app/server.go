@@ -2,6 +2,7 @@ package app
 
 import (
 	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
 	"github.com/sqlpub/qin-cdc/config"
 	"github.com/sqlpub/qin-cdc/core"
 	_ "github.com/sqlpub/qin-cdc/inputs"
@@ -84,13 +85,37 @@ func NewServer(conf *config.Config) (server *Server, err error) {
 	// new position
 	server.Position.LoadPosition(conf.Name)
 	// new output
+	if named, ok := server.Output.(core.OutputName); ok {
+		named.SetName(conf.Name)
+	}
 	server.Output.NewOutput(server.Metas)
+	// output checkpoint position
+	err = server.loadOutputCheckpoint(conf.Name)
+	if err != nil {
+		return nil, err
+	}
 	// new input
 	server.Input.NewInput(server.Metas)
 
 	return server, nil
 }
 
+func (s *Server) loadOutputCheckpoint(name string) error {
+	checkpoint, ok := s.Output.(core.OutputCheckpoint)
+	if !ok {
+		return nil
+	}
+	pos, err := checkpoint.LoadCheckpoint(name)
+	if err != nil {
+		return err
+	}
+	if pos == "" {
+		return nil
+	}
+	log.Infof("load position from output checkpoint: %s", pos)
+	return s.Position.Update(pos)
+}
+
 func (s *Server) initMeta(conf *config.Config) (err error) {
 	// Routers
 	s.Metas = &core.Metas{
@@ -10,6 +10,12 @@ type MysqlConfig struct {
 		ServerId        int    `toml:"server-id"`
 		BatchSize       int    `toml:"batch-size"`
 		BatchIntervalMs int    `toml:"batch-interval-ms"`
+		ApplyMode       string `toml:"apply-mode" mapstructure:"apply-mode"`             // output, table or transaction
+		ParallelWorkers int    `toml:"parallel-workers" mapstructure:"parallel-workers"` // output, table apply mode workers
+		ExactlyOnce     bool   `toml:"exactly-once" mapstructure:"exactly-once"`         // output, position written to checkpoint-table with data
+		CheckpointTable string `toml:"checkpoint-table" mapstructure:"checkpoint-table"` // output, schema.table
+		TableWorkers    int    `toml:"table-workers" mapstructure:"table-workers"`       // output, table apply mode tables flushed concurrently
+		Compact         bool   `toml:"compact" mapstructure:"compact"`                   // output, merge changes of a primary key in a batch
 	}
 }
 
@@ -20,8 +26,22 @@ type StarrocksConfig struct {
 	UserName string
 	Password string
 	Options  struct {
-		BatchSize       int `toml:"batch-size" mapstructure:"batch-size"`
-		BatchIntervalMs int `toml:"batch-interval-ms" mapstructure:"batch-interval-ms"`
+		BatchSize       int    `toml:"batch-size" mapstructure:"batch-size"`
+		BatchIntervalMs int    `toml:"batch-interval-ms" mapstructure:"batch-interval-ms"`
+		TwoPhaseCommit  bool   `toml:"two-phase-commit" mapstructure:"two-phase-commit"` // prepare all tables of a flush, then commit
+		PartialUpdate   bool   `toml:"partial-update" mapstructure:"partial-update"`     // load changed columns of updates only
+		Format          string `toml:"format" mapstructure:"format"`                     // json or csv
+		ColumnSeparator string `toml:"column-separator" mapstructure:"column-separator"` // csv column separator
+		RowDelimiter    string `toml:"row-delimiter" mapstructure:"row-delimiter"`       // csv row delimiter
+		Compress        string `toml:"compress" mapstructure:"compress"`                 // gzip or lz4
+		Compact         bool   `toml:"compact" mapstructure:"compact"`                   // merge changes of a primary key in a batch
+
+		MergeCommit           string `toml:"merge-commit" mapstructure:"merge-commit"` // async or sync
+		MergeCommitIntervalMs int    `toml:"merge-commit-interval-ms" mapstructure:"merge-commit-interval-ms"`
+		MergeCommitParallel   int    `toml:"merge-commit-parallel" mapstructure:"merge-commit-parallel"`
+
+		MaxConcurrentLoads int `toml:"max-concurrent-loads" mapstructure:"max-concurrent-loads"`   // concurrent table loads of a flush
+		MaxBatchIntervalMs int `toml:"max-batch-interval-ms" mapstructure:"max-batch-interval-ms"` // flush interval grows up to it when loads are slow
 	}
 }
 
@@ -32,17 +52,60 @@ type DorisConfig struct {
 	UserName string
 	Password string
 	Options  struct {
-		BatchSize       int `toml:"batch-size" mapstructure:"batch-size"`
-		BatchIntervalMs int `toml:"batch-interval-ms" mapstructure:"batch-interval-ms"`
+		BatchSize       int    `toml:"batch-size" mapstructure:"batch-size"`
+		BatchIntervalMs int    `toml:"batch-interval-ms" mapstructure:"batch-interval-ms"`
+		TwoPhaseCommit  bool   `toml:"two-phase-commit" mapstructure:"two-phase-commit"` // prepare all tables of a flush, then commit
+		PartialUpdate   bool   `toml:"partial-update" mapstructure:"partial-update"`     // load changed columns of updates only
+		Format          string `toml:"format" mapstructure:"format"`                     // json or csv
+		ColumnSeparator string `toml:"column-separator" mapstructure:"column-separator"` // csv column separator
+		RowDelimiter    string `toml:"row-delimiter" mapstructure:"row-delimiter"`       // csv row delimiter
+		Compress        string `toml:"compress" mapstructure:"compress"`                 // gzip or lz4
+		Compact         bool   `toml:"compact" mapstructure:"compact"`                   // merge changes of a primary key in a batch
+		GroupCommit     string `toml:"group-commit" mapstructure:"group-commit"`         // async or sync
+
+		MaxConcurrentLoads int `toml:"max-concurrent-loads" mapstructure:"max-concurrent-loads"`   // concurrent table loads of a flush
+		MaxBatchIntervalMs int `toml:"max-batch-interval-ms" mapstructure:"max-batch-interval-ms"` // flush interval grows up to it when loads are slow
 	}
 }
 
 type KafkaConfig struct {
-	Brokers      []string `toml:"brokers"`
-	PartitionNum int      `toml:"partition-num" mapstructure:"partition-num"`
-	Options      struct {
+	Brokers          []string `toml:"brokers"`
+	PartitionNum     int      `toml:"partition-num" mapstructure:"partition-num"`
+	SecurityProtocol string   `toml:"security-protocol" mapstructure:"security-protocol"` // plaintext, ssl, sasl_plaintext, sasl_ssl
+	Sasl             struct {
+		Mechanism string `toml:"mechanism"` // PLAIN, SCRAM-SHA-256, SCRAM-SHA-512
+		UserName  string
+		Password  string
+	}
+	Tls struct {
+		CaFile      string `toml:"ca-file" mapstructure:"ca-file"`
+		CertFile    string `toml:"cert-file" mapstructure:"cert-file"`
+		KeyFile     string `toml:"key-file" mapstructure:"key-file"`
+		KeyPassword string `toml:"key-password" mapstructure:"key-password"`
+	}
+	// librdkafka properties, override producer defaults, e.g. acks, linger.ms, message.max.bytes
+	Properties map[string]interface{} `toml:"properties"`
+	// librdkafka properties of the exactly once checkpoint consumer, e.g. fetch.max.bytes
+	ConsumerProperties map[string]interface{} `toml:"consumer-properties" mapstructure:"consumer-properties"`
+	Options            struct {
 		BatchSize       int    `toml:"batch-size" mapstructure:"batch-size"`
 		BatchIntervalMs int    `toml:"batch-interval-ms" mapstructure:"batch-interval-ms"`
 		OutputFormat    string `toml:"output-format" mapstructure:"output-format"`
+		PartitionBy     string `toml:"partition-by" mapstructure:"partition-by"` // primary-key, table, column, transaction
+		KeyFormat       string `toml:"key-format" mapstructure:"key-format"`     // hash, json
+		// debezium output format
+		DebeziumServerName          string `toml:"debezium-server-name" mapstructure:"debezium-server-name"`
+		DebeziumSchemasEnable       bool   `toml:"debezium-schemas-enable" mapstructure:"debezium-schemas-enable"`
+		DebeziumDecimalHandlingMode string `toml:"debezium-decimal-handling-mode" mapstructure:"debezium-decimal-handling-mode"` // precise, string, double
+		TombstonesOnDelete          bool   `toml:"tombstones-on-delete" mapstructure:"tombstones-on-delete"`
+		// avro output format
+		SchemaRegistryUrl      string `toml:"schema-registry-url" mapstructure:"schema-registry-url"`
+		SchemaRegistryUserName string `toml:"schema-registry-username" mapstructure:"schema-registry-username"`
+		SchemaRegistryPassword string `toml:"schema-registry-password" mapstructure:"schema-registry-password"`
+		SubjectNameStrategy    string `toml:"subject-name-strategy" mapstructure:"subject-name-strategy"`
+		// exactly once, transactional producer
+		ExactlyOnce     bool   `toml:"exactly-once" mapstructure:"exactly-once"`
+		TransactionalId string `toml:"transactional-id" mapstructure:"transactional-id"`
+		CheckpointTopic string `toml:"checkpoint-topic" mapstructure:"checkpoint-topic"`
 	}
 }
@@ -3,6 +3,7 @@ package core
 import (
 	"github.com/juju/errors"
 	"github.com/sqlpub/qin-cdc/metas"
+	"slices"
 )
 
 type InputMeta interface {
@@ -51,6 +52,28 @@ func (m *Metas) InitRouterColumnsMapper() error {
 				router.ColumnsMapper.PrimaryKeys = append(router.ColumnsMapper.PrimaryKeys, column.Name)
 			}
 		}
+		if len(router.KeyColumns) > 0 {
+			// user config output.config.routers.key-columns
+			for _, keyColumn := range router.KeyColumns {
+				if !slices.Contains(router.ColumnsMapper.SourceColumns, keyColumn) {
+					return errors.Errorf("router %s.%s key-columns %s not found in source table", router.SourceSchema, router.SourceTable, keyColumn)
+				}
+			}
+			router.ColumnsMapper.RowKeys = router.KeyColumns
+		} else if len(router.ColumnsMapper.PrimaryKeys) > 0 {
+			router.ColumnsMapper.RowKeys = router.ColumnsMapper.PrimaryKeys
+		} else {
+			// no primary key, not null unique key identifies a row
+			router.ColumnsMapper.RowKeys = inputTable.NotNullUniqueKey()
+		}
+		if len(router.ColumnsMapper.PrimaryKeys) > 0 && !slices.Equal(router.ColumnsMapper.PrimaryKeys, router.ColumnsMapper.RowKeys) {
+			router.ColumnsMapper.UniqueKeys = append(router.ColumnsMapper.UniqueKeys, router.ColumnsMapper.PrimaryKeys)
+		}
+		for _, uniqueKey := range inputTable.UniqueKeys {
+			if len(uniqueKey.Columns) > 0 && !slices.Equal(uniqueKey.Columns, router.ColumnsMapper.RowKeys) {
+				router.ColumnsMapper.UniqueKeys = append(router.ColumnsMapper.UniqueKeys, uniqueKey.Columns)
+			}
+		}
 		metaObj, err := m.Output.GetMeta(router)
 		if err != nil {
 			return err
@@ -66,6 +89,7 @@ func (m *Metas) InitRouterColumnsMapper() error {
 			}
 		} else {
 			// target == source
+			router.ColumnsMapper.SourceAsTarget = true
 			for _, column := range inputTable.Columns {
 				router.ColumnsMapper.TargetColumns = append(router.ColumnsMapper.TargetColumns, column.Name)
 			}
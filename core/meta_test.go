@@ -0,0 +1,71 @@
+package core
+
+import (
+	"github.com/sqlpub/qin-cdc/metas"
+	"slices"
+	"testing"
+)
+
+type testInputMeta struct {
+	tables map[string]*metas.Table
+}
+
+func (m *testInputMeta) LoadMeta([]*metas.Router) error { return nil }
+func (m *testInputMeta) GetMeta(router *metas.Router) (*metas.Table, error) {
+	return m.tables[router.SourceTable], nil
+}
+func (m *testInputMeta) GetVersion(string, string, uint) (*metas.Table, error) { return nil, nil }
+func (m *testInputMeta) Save() error                                           { return nil }
+func (m *testInputMeta) Close()                                                {}
+
+// testOutputMeta target == source
+type testOutputMeta struct{}
+
+func (m *testOutputMeta) LoadMeta([]*metas.Router) error             { return nil }
+func (m *testOutputMeta) GetMeta(*metas.Router) (interface{}, error) { return nil, nil }
+func (m *testOutputMeta) Save() error                                { return nil }
+func (m *testOutputMeta) Close()                                     {}
+
+func TestInitRouterColumnsMapperRowKeys(t *testing.T) {
+	pk := &metas.Table{Name: "pk", Columns: []metas.Column{
+		{Name: "id", IsPrimaryKey: true, IsNotNull: true}, {Name: "code", IsNotNull: true}}}
+	uk := &metas.Table{Name: "uk", Columns: []metas.Column{{Name: "id"}, {Name: "code", IsNotNull: true}},
+		UniqueKeys: []metas.UniqueKey{{Name: "uk_id", Columns: []string{"id"}}, {Name: "uk_code", Columns: []string{"code"}}}}
+	tests := []struct {
+		router      *metas.Router
+		primaryKeys []string
+		rowKeys     []string
+		uniqueKeys  [][]string
+	}{
+		{&metas.Router{SourceTable: "pk"}, []string{"id"}, []string{"id"}, nil},
+		// key-columns only changes the mysql output row identity, primary key is another unique key
+		{&metas.Router{SourceTable: "pk", KeyColumns: []string{"code"}}, []string{"id"}, []string{"code"}, [][]string{{"id"}}},
+		{&metas.Router{SourceTable: "uk"}, nil, []string{"code"}, [][]string{{"id"}}},
+	}
+	for _, tt := range tests {
+		m := &Metas{
+			Input:   &testInputMeta{tables: map[string]*metas.Table{"pk": pk, "uk": uk}},
+			Output:  &testOutputMeta{},
+			Routers: &metas.Routers{Raws: []*metas.Router{tt.router}},
+		}
+		if err := m.InitRouterColumnsMapper(); err != nil {
+			t.Fatal(err)
+		}
+		columnsMapper := tt.router.ColumnsMapper
+		if !slices.Equal(columnsMapper.PrimaryKeys, tt.primaryKeys) || !slices.Equal(columnsMapper.RowKeys, tt.rowKeys) {
+			t.Errorf("%s key-columns %v: primary keys %v, row keys %v", tt.router.SourceTable, tt.router.KeyColumns,
+				columnsMapper.PrimaryKeys, columnsMapper.RowKeys)
+		}
+		if !slices.EqualFunc(columnsMapper.UniqueKeys, tt.uniqueKeys, slices.Equal) {
+			t.Errorf("%s key-columns %v: unique keys %v", tt.router.SourceTable, tt.router.KeyColumns, columnsMapper.UniqueKeys)
+		}
+		if !columnsMapper.SourceAsTarget {
+			t.Errorf("output without table meta: target columns are not the source columns")
+		}
+	}
+	m := &Metas{Input: &testInputMeta{tables: map[string]*metas.Table{"pk": pk}}, Output: &testOutputMeta{},
+		Routers: &metas.Routers{Raws: []*metas.Router{{SourceTable: "pk", KeyColumns: []string{"missing"}}}}}
+	if err := m.InitRouterColumnsMapper(); err == nil {
+		t.Errorf("unknown key-columns: expected error")
+	}
+}
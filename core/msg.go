@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/goccy/go-json"
 	"github.com/sqlpub/qin-cdc/metas"
+	"reflect"
 	"time"
 )
 
@@ -35,7 +36,11 @@ type Msg struct {
 	DmlMsg       *DMLMsg
 	Timestamp    time.Time
 	InputContext struct {
-		Pos string
+		Pos      string
+		ServerId uint32 // source event server id
+		Gtid     string // source event transaction gtid
+		LogName  string // source event binlog file
+		LogPos   uint32 // source event binlog position
 	}
 }
 
@@ -66,3 +71,131 @@ func (m *Msg) ToString() string {
 	}
 	return ""
 }
+
+// PrimaryKeyChanged update changes any of the key columns
+func (m *DMLMsg) PrimaryKeyChanged(primaryKeys []string) bool {
+	if m.Action != UpdateAction || m.Old == nil {
+		return false
+	}
+	for _, pk := range primaryKeys {
+		if !reflect.DeepEqual(m.Data[pk], m.Old[pk]) {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitPrimaryKeyChange replace key changed update with delete of old key followed by upsert of new key,
+// other msgs are kept as is, order is kept
+func SplitPrimaryKeyChange(msgs []*Msg, primaryKeys []string) []*Msg {
+	if len(primaryKeys) == 0 {
+		return msgs
+	}
+	var splitMsgs []*Msg
+	for i, msg := range msgs {
+		if !msg.DmlMsg.PrimaryKeyChanged(primaryKeys) {
+			if splitMsgs != nil {
+				splitMsgs = append(splitMsgs, msg)
+			}
+			continue
+		}
+		if splitMsgs == nil {
+			splitMsgs = make([]*Msg, 0, len(msgs)+1)
+			splitMsgs = append(splitMsgs, msgs[:i]...)
+		}
+		deleteMsg := *msg
+		deleteMsg.DmlMsg = &DMLMsg{Action: DeleteAction, Data: msg.DmlMsg.Old, TableVersion: msg.DmlMsg.TableVersion}
+		upsertMsg := *msg
+		upsertMsg.DmlMsg = &DMLMsg{Action: InsertAction, Data: msg.DmlMsg.Data, TableVersion: msg.DmlMsg.TableVersion}
+		splitMsgs = append(splitMsgs, &deleteMsg, &upsertMsg)
+	}
+	if splitMsgs == nil {
+		return msgs
+	}
+	return splitMsgs
+}
+
+// CompactMsgs collapse changes of the same primary key in msgs to the final state, msgs must not change
+// primary key (see SplitPrimaryKeyChange). A key deleted in the end stays a delete even if inserted in msgs,
+// a replayed batch may find the row written before; a key deleted then written again is the delete followed by
+// the final upsert; an update chain is one update from the first old image to the last new image.
+// Compacted msgs of a key take the place of its last msg, changes of different keys are reordered,
+// targets with unique keys besides primaryKeys must not compact
+func CompactMsgs(msgs []*Msg, primaryKeys []string) []*Msg {
+	return compactMsgs(msgs, primaryKeys, false)
+}
+
+// CompactUpsertMsgs CompactMsgs for targets where an insert keeps an existing row, e.g. insert ignore:
+// an insert followed by updates is an update of the last row, a replayed batch still applies the updates
+func CompactUpsertMsgs(msgs []*Msg, primaryKeys []string) []*Msg {
+	return compactMsgs(msgs, primaryKeys, true)
+}
+
+func compactMsgs(msgs []*Msg, primaryKeys []string, insertAsUpdate bool) []*Msg {
+	if len(primaryKeys) == 0 || len(msgs) < 2 {
+		return msgs
+	}
+	type keyState struct {
+		deleteMsg *Msg // last delete before the upsert chain
+		upsertMsg *Msg // upsert chain since the last delete
+		last      int
+	}
+	states := make(map[string]*keyState)
+	keys := make([]string, len(msgs))
+	for i, msg := range msgs {
+		values := make([]interface{}, 0, len(primaryKeys))
+		for _, pk := range primaryKeys {
+			values = append(values, msg.DmlMsg.Data[pk])
+		}
+		b, _ := json.Marshal(values)
+		keys[i] = string(b)
+		state, ok := states[keys[i]]
+		if !ok {
+			state = &keyState{}
+			states[keys[i]] = state
+		}
+		state.last = i
+		switch msg.DmlMsg.Action {
+		case DeleteAction:
+			state.deleteMsg = msg
+			state.upsertMsg = nil
+		case UpdateAction:
+			if state.upsertMsg == nil {
+				state.upsertMsg = msg
+				continue
+			}
+			// insert or replace followed by updates is still an insert or replace of the last row
+			action := state.upsertMsg.DmlMsg.Action
+			if insertAsUpdate && action == InsertAction {
+				action = UpdateAction
+			}
+			mergedMsg := *msg
+			mergedMsg.DmlMsg = &DMLMsg{
+				Action:       action,
+				Data:         msg.DmlMsg.Data,
+				Old:          state.upsertMsg.DmlMsg.Old,
+				TableVersion: msg.DmlMsg.TableVersion,
+			}
+			state.upsertMsg = &mergedMsg
+		default:
+			state.upsertMsg = msg
+		}
+	}
+	if len(states) == len(msgs) {
+		return msgs
+	}
+	compactedMsgs := make([]*Msg, 0, len(states)*2)
+	for i, key := range keys {
+		state := states[key]
+		if state.last != i {
+			continue
+		}
+		if state.deleteMsg != nil {
+			compactedMsgs = append(compactedMsgs, state.deleteMsg)
+		}
+		if state.upsertMsg != nil {
+			compactedMsgs = append(compactedMsgs, state.upsertMsg)
+		}
+	}
+	return compactedMsgs
+}
@@ -0,0 +1,37 @@
+package core
+
+import "testing"
+
+func testDmlMsg(action ActionType, data map[string]interface{}, old map[string]interface{}) *Msg {
+	return &Msg{Type: MsgDML, DmlMsg: &DMLMsg{Action: action, Data: data, Old: old}}
+}
+
+func TestCompactMsgs(t *testing.T) {
+	msgs := []*Msg{
+		testDmlMsg(InsertAction, map[string]interface{}{"id": 1, "v": "a"}, nil),
+		testDmlMsg(UpdateAction, map[string]interface{}{"id": 1, "v": "b"}, map[string]interface{}{"id": 1, "v": "a"}),
+		testDmlMsg(InsertAction, map[string]interface{}{"id": 2, "v": "c"}, nil),
+	}
+	tests := []struct {
+		name    string
+		compact func([]*Msg, []string) []*Msg
+		action  ActionType
+	}{
+		{"CompactMsgs", CompactMsgs, InsertAction},
+		// insert ignore would keep an existing row and lose the update
+		{"CompactUpsertMsgs", CompactUpsertMsgs, UpdateAction},
+	}
+	for _, tt := range tests {
+		compacted := tt.compact(msgs, []string{"id"})
+		if len(compacted) != 2 {
+			t.Fatalf("%s: %d msgs, want 2", tt.name, len(compacted))
+		}
+		merged := compacted[0].DmlMsg
+		if merged.Action != tt.action || merged.Data["v"] != "b" || merged.Old != nil {
+			t.Errorf("%s: merged msg %+v", tt.name, merged)
+		}
+		if compacted[1].DmlMsg.Action != InsertAction {
+			t.Errorf("%s: single insert changed to %s", tt.name, compacted[1].DmlMsg.Action)
+		}
+	}
+}
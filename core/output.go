@@ -5,3 +5,14 @@ type Output interface {
 	Start(out chan *Msg, pos Position)
 	Close()
 }
+
+// OutputName optional, output receives the pipeline name before NewOutput, e.g. to derive target side identifiers
+type OutputName interface {
+	SetName(name string)
+}
+
+// OutputCheckpoint optional, output writes position to target in the same transaction as data,
+// position loaded from target on startup takes precedence over local position
+type OutputCheckpoint interface {
+	LoadCheckpoint(name string) (string, error)
+}
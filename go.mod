@@ -13,6 +13,7 @@ require (
 	github.com/juju/errors v1.0.0
 	github.com/mitchellh/hashstructure/v2 v2.0.2
 	github.com/mitchellh/mapstructure v1.5.0
+	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/pingcap/tidb/pkg/parser v0.0.0-20240516062813-cc127c14b8cc
 	github.com/prometheus/client_golang v1.19.1
 	github.com/sevlyar/go-daemon v0.1.6
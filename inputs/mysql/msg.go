@@ -83,6 +83,16 @@ func (i *InputPlugin) NewXIDMsg(ev *replication.XIDEvent, header *replication.Ev
 	return msg, nil
 }
 
+// NewCommitMsg commit query event ends transactions of non-transactional engines (e.g. MyISAM), which have no xid
+func (i *InputPlugin) NewCommitMsg(ev *replication.QueryEvent, header *replication.EventHeader) (msg *core.Msg, err error) {
+	msg = &core.Msg{
+		Type:      core.MsgCtl,
+		Timestamp: time.Unix(int64(header.Timestamp), 0),
+	}
+	msg.InputContext.Pos = ev.GSet.String()
+	return msg, nil
+}
+
 func (i *InputPlugin) SendMsgs(msgs []*core.Msg) {
 	for _, msg := range msgs {
 		i.SendMsg(msg)
@@ -108,9 +108,21 @@ func (b *BinlogTailer) handleRowsEvent(ev *replication.BinlogEvent) {
 	if err != nil {
 		log.Fatalf("%v event handle failed: %s", actionType, err.Error())
 	}
+	for _, msg := range msgs {
+		b.fillInputContext(msg, ev.Header)
+	}
 	b.inputPlugin.SendMsgs(msgs)
 }
 
+func (b *BinlogTailer) fillInputContext(msg *core.Msg, header *replication.EventHeader) {
+	msg.InputContext.ServerId = header.ServerID
+	if b.GSet != nil {
+		msg.InputContext.Gtid = b.GSet.String()
+	}
+	msg.InputContext.LogName = b.Pos.Name
+	msg.InputContext.LogPos = header.LogPos
+}
+
 func (b *BinlogTailer) handleXIDEvent(ev *replication.BinlogEvent) {
 	e := ev.Event.(*replication.XIDEvent)
 	msg, err := b.inputPlugin.NewXIDMsg(e, ev.Header)
@@ -136,6 +148,14 @@ func (b *BinlogTailer) handleDDLEvent(ev *replication.BinlogEvent) {
 	if ddlSql == "BEGIN" {
 		return
 	}
+	if ddlSql == "COMMIT" {
+		msg, err := b.inputPlugin.NewCommitMsg(e, ev.Header)
+		if err != nil {
+			log.Fatalf("commit event handle failed: %s", err.Error())
+		}
+		b.inputPlugin.SendMsg(msg)
+		return
+	}
 	ddlStatements, err := metas.TableDdlParser(ddlSql, schemaName)
 	if err != nil {
 		log.Fatalf("ddl event handle failed: %s", err.Error())
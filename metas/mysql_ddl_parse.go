@@ -9,6 +9,7 @@ import (
 	"github.com/pingcap/tidb/pkg/parser/format"
 	"github.com/pingcap/tidb/pkg/parser/mysql"
 	"github.com/pingcap/tidb/pkg/parser/test_driver"
+	"strings"
 )
 
 var p *parser.Parser
@@ -63,10 +64,13 @@ func columnDefParse(columnDef *ast.ColumnDef) Column {
 		case ast.ColumnOptionNoOption:
 		case ast.ColumnOptionPrimaryKey:
 			tableColumn.IsPrimaryKey = true
+			tableColumn.IsNotNull = true
 		case ast.ColumnOptionNotNull:
+			tableColumn.IsNotNull = true
 		case ast.ColumnOptionAutoIncrement:
 		case ast.ColumnOptionDefaultValue:
 		case ast.ColumnOptionUniqKey:
+			tableColumn.IsUniqueKey = true
 		case ast.ColumnOptionNull:
 		case ast.ColumnOptionOnUpdate: // For Timestamp and Datetime only.
 		case ast.ColumnOptionFulltext:
@@ -124,6 +128,9 @@ func TableDdlHandle(tab *Table, sql string) error {
 					if tableColumn.IsPrimaryKey {
 						tab.PrimaryKeyColumns = append(tab.PrimaryKeyColumns, tableColumn)
 					}
+					if tableColumn.IsUniqueKey {
+						tab.UniqueKeys = append(tab.UniqueKeys, UniqueKey{Name: tableColumn.Name, Columns: []string{tableColumn.Name}})
+					}
 					if relativeColumn != "" {
 						for i, column2 := range tab.Columns {
 							// add new column to relative column after
@@ -139,6 +146,10 @@ func TableDdlHandle(tab *Table, sql string) error {
 					}
 				}
 			case ast.AlterTableAddConstraint:
+				switch alterTableSpec.Constraint.Tp {
+				case ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+					tab.UniqueKeys = append(tab.UniqueKeys, uniqueKeyParse(alterTableSpec.Constraint))
+				}
 			case ast.AlterTableDropColumn:
 				oldColumnName := alterTableSpec.OldColumnName.Name.String()
 				for i, column := range tab.Columns {
@@ -148,6 +159,12 @@ func TableDdlHandle(tab *Table, sql string) error {
 				}
 			case ast.AlterTableDropPrimaryKey:
 			case ast.AlterTableDropIndex:
+				for i, uniqueKey := range tab.UniqueKeys {
+					if strings.EqualFold(uniqueKey.Name, alterTableSpec.Name) {
+						tab.UniqueKeys = append(tab.UniqueKeys[:i], tab.UniqueKeys[i+1:]...)
+						break
+					}
+				}
 			case ast.AlterTableDropForeignKey:
 			case ast.AlterTableModifyColumn:
 				relativeColumn := ""
@@ -328,6 +345,9 @@ func TableDdlHandle(tab *Table, sql string) error {
 			if tableColumn.IsPrimaryKey {
 				tab.PrimaryKeyColumns = append(tab.PrimaryKeyColumns, tableColumn)
 			}
+			if tableColumn.IsUniqueKey {
+				tab.UniqueKeys = append(tab.UniqueKeys, UniqueKey{Name: tableColumn.Name, Columns: []string{tableColumn.Name}})
+			}
 			tab.Columns = append(tab.Columns, tableColumn)
 		}
 		for _, constraint := range t.Constraints {
@@ -338,6 +358,7 @@ func TableDdlHandle(tab *Table, sql string) error {
 					for i, column := range tab.Columns {
 						if keyName == column.Name {
 							tab.Columns[i].IsPrimaryKey = true
+							tab.Columns[i].IsNotNull = true
 							tab.PrimaryKeyColumns = append(tab.PrimaryKeyColumns, tab.Columns[i])
 							break
 						}
@@ -345,9 +366,8 @@ func TableDdlHandle(tab *Table, sql string) error {
 				}
 			case ast.ConstraintKey:
 			case ast.ConstraintIndex:
-			case ast.ConstraintUniq:
-			case ast.ConstraintUniqKey:
-			case ast.ConstraintUniqIndex:
+			case ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+				tab.UniqueKeys = append(tab.UniqueKeys, uniqueKeyParse(constraint))
 			case ast.ConstraintForeignKey:
 			case ast.ConstraintFulltext:
 			case ast.ConstraintCheck:
@@ -560,3 +580,19 @@ func TableRestore(astNode interface{}) (rawSql string, err error) {
 		return "", errors.New(fmt.Sprintf("not support table restore, type: %v", t))
 	}
 }
+
+func uniqueKeyParse(constraint *ast.Constraint) UniqueKey {
+	uniqueKey := UniqueKey{Name: constraint.Name}
+	for _, key := range constraint.Keys {
+		if key.Column == nil { // functional key part, can not identify a row by column values
+			uniqueKey.Columns = nil
+			break
+		}
+		uniqueKey.Columns = append(uniqueKey.Columns, key.Column.Name.String())
+	}
+	if uniqueKey.Name == "" && len(uniqueKey.Columns) > 0 {
+		// mysql names an unnamed index after its first column
+		uniqueKey.Name = uniqueKey.Columns[0]
+	}
+	return uniqueKey
+}
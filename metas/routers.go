@@ -12,14 +12,23 @@ type Router struct {
 	SourceTable   string `mapstructure:"source-table"`
 	TargetSchema  string `mapstructure:"target-schema"`
 	TargetTable   string `mapstructure:"target-table"`
-	DmlTopic      string `mapstructure:"dml-topic"`
+	DmlTopic      string `mapstructure:"dml-topic"` // support template {schema}, {table}
 	ColumnsMapper ColumnsMapper
+
+	PartitionColumn string   `mapstructure:"partition-column"` // kafka partition-by column
+	KeyColumns      []string `mapstructure:"key-columns"`      // source columns identify a row, default primary key or not null unique key
+	ConflictPolicy  string   `mapstructure:"conflict-policy"`  // mysql output: overwrite, ignore, fail, newer-wins
+	ConflictColumn  string   `mapstructure:"conflict-column"`  // mysql output newer-wins timestamp or version column
 }
 
 type ColumnsMapper struct {
-	PrimaryKeys    []string // source
+	PrimaryKeys    []string   // source, primary key columns
+	RowKeys        []string   // source, mysql output row identity: key-columns, primary key or not null unique key, empty if table has no key
+	UniqueKeys     [][]string // source, unique keys besides the row keys, rows with equal values conflict
 	SourceColumns  []string
 	TargetColumns  []string
+	MetaColumns    []string // source, columns added with event metadata values (e.g. _op, _ts), not part of the row image
+	SourceAsTarget bool     // output has no table meta (e.g. kafka), target columns are the source columns, all row columns are written
 	MapMapper      map[string]string
 	MapMapperOrder []string
 }
@@ -26,6 +26,7 @@ type Table struct {
 	Comment           string
 	Columns           []Column
 	PrimaryKeyColumns []Column
+	UniqueKeys        []UniqueKey
 	Version           uint
 }
 
@@ -35,6 +36,13 @@ type Column struct {
 	RawType      string
 	Comment      string
 	IsPrimaryKey bool
+	IsUniqueKey  bool // column level unique key
+	IsNotNull    bool
+}
+
+type UniqueKey struct {
+	Name    string
+	Columns []string
 }
 
 type DdlStatement struct {
@@ -68,3 +76,30 @@ func (t *Table) DeepCopy() (*Table, error) {
 	}
 	return ret, nil
 }
+
+// NotNullUniqueKey first unique key whose columns are all not null, it identifies a row like a primary key
+func (t *Table) NotNullUniqueKey() []string {
+	for _, uniqueKey := range t.UniqueKeys {
+		if len(uniqueKey.Columns) == 0 {
+			continue
+		}
+		notNull := true
+		for _, keyName := range uniqueKey.Columns {
+			found := false
+			for _, column := range t.Columns {
+				if column.Name == keyName {
+					found = column.IsNotNull
+					break
+				}
+			}
+			if !found {
+				notNull = false
+				break
+			}
+		}
+		if notNull {
+			return uniqueKey.Columns
+		}
+	}
+	return nil
+}
@@ -22,6 +22,16 @@ var OpsWriteProcessed = promauto.NewCounter(prometheus.CounterOpts{
 	Help: "The total number of write processed events",
 })
 
+var OpsWriteConflicts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qin_cdc_write_conflict_ops_total",
+	Help: "The total number of write conflict events",
+})
+
+var OpsWriteCompacted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qin_cdc_write_compacted_ops_total",
+	Help: "The total number of events merged by primary key before write",
+})
+
 var DelayReadTime = prometheus.NewGauge(prometheus.GaugeOpts{
 	Namespace: "qin_cdc",
 	Subsystem: "read_delay",
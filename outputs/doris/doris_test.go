@@ -0,0 +1,60 @@
+package doris
+
+import (
+	"github.com/sqlpub/qin-cdc/metas"
+	"github.com/sqlpub/qin-cdc/outputs/streamload"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestDialectHeaders doris headers of a load, engine headers are tested in streamload
+func TestDialectHeaders(t *testing.T) {
+	d := &dialect{}
+	tests := []struct {
+		name string
+		set  func(req *http.Request)
+		want http.Header
+	}{
+		{"merge", func(req *http.Request) {
+			d.SetHeaders(req, metas.ColumnsMapper{SourceColumns: []string{"id", "v"}})
+		}, http.Header{"Merge_type": {"MERGE"}, "Delete": {"_delete_sign_=1"}, "Columns": {"id,v,_delete_sign_"}}},
+		{"partial", func(req *http.Request) {
+			d.SetPartialHeaders(req, []string{"id", "v"})
+		}, http.Header{"Partial_columns": {"true"}, "Columns": {"id,v"}}},
+		{"json", func(req *http.Request) {
+			d.SetFormatHeaders(req, &streamload.Config{Format: streamload.FormatJson})
+		}, http.Header{}},
+		{"csv gzip", func(req *http.Request) {
+			d.SetFormatHeaders(req, &streamload.Config{Format: streamload.FormatCsv, ColumnSeparator: "\t",
+				RowDelimiter: "\n", Compress: streamload.CompressGzip})
+		}, http.Header{"Format": {"csv"}, "Column_separator": {`\x09`}, "Line_delimiter": {`\x0a`},
+			"Enclose": {`"`}, "Escape": {`\`}, "Compress_type": {"gz"}}},
+		{"csv lz4", func(req *http.Request) {
+			d.SetFormatHeaders(req, &streamload.Config{Format: streamload.FormatCsv, ColumnSeparator: "\t",
+				RowDelimiter: "\n", Compress: streamload.CompressLz4})
+		}, http.Header{"Format": {"csv"}, "Column_separator": {`\x09`}, "Line_delimiter": {`\x0a`},
+			"Enclose": {`"`}, "Escape": {`\`}, "Compress_type": {"lz4"}}},
+		{"group commit async", func(req *http.Request) {
+			d.SetGroupCommitHeaders(req, streamload.GroupCommitAsync)
+		}, http.Header{"Group_commit": {"async_mode"}}},
+		{"group commit sync", func(req *http.Request) {
+			d.SetGroupCommitHeaders(req, streamload.GroupCommitSync)
+		}, http.Header{"Group_commit": {"sync_mode"}}},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("PUT", "http://fe:8030/api/db/t/_stream_load", nil)
+		tt.set(req)
+		if !reflect.DeepEqual(req.Header, tt.want) {
+			t.Errorf("%s: headers = %v, want %v", tt.name, req.Header, tt.want)
+		}
+	}
+}
+
+// TestConfigureCompress doris decompresses csv loads only
+func TestConfigureCompress(t *testing.T) {
+	if err := (&OutputPlugin{}).Configure(map[string]interface{}{"target": map[string]interface{}{
+		"options": map[string]interface{}{"compress": "gzip"}}}); err == nil {
+		t.Errorf("json compress: expected error")
+	}
+}
@@ -0,0 +1,69 @@
+package doris
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sqlpub/qin-cdc/outputs/streamload"
+	"strconv"
+)
+
+const (
+	txnCommit = "commit"
+	txnAbort  = "abort"
+)
+
+// Prepare stream load with two_phase_commit, data is invisible until commit
+func (d *dialect) Prepare(o *streamload.Output, load *streamload.Load) error {
+	req := o.NewLoadRequest("PUT", fmt.Sprintf("/api/%s/%s/_stream_load", load.TargetSchema, load.TargetTable), load)
+	req.Header.Add("two_phase_commit", "true")
+	returnMap, err := o.Send(req)
+	if err != nil {
+		return err
+	}
+	switch returnMap["Status"] {
+	case "Success":
+		txnId, ok := returnMap["TxnId"].(float64)
+		if !ok {
+			return errors.Errorf("prepare load %s response missing TxnId: %v", load.Label, returnMap)
+		}
+		load.TxnId = int64(txnId)
+		return nil
+	case "Label Already Exists":
+		if returnMap["ExistingJobStatus"] == "FINISHED" {
+			load.Committed = true
+			return nil
+		}
+		// prepared by a previous attempt, abort it and load again
+		if err = d.Abort(o, load); err != nil {
+			return err
+		}
+		return errors.Errorf("prepare load %s label already exists, existing job aborted", load.Label)
+	}
+	return streamload.LoadError(returnMap, load)
+}
+
+func (d *dialect) Commit(o *streamload.Output, load *streamload.Load) error {
+	return d.txnOperation(o, load, txnCommit)
+}
+
+func (d *dialect) Abort(o *streamload.Output, load *streamload.Load) error {
+	return d.txnOperation(o, load, txnAbort)
+}
+
+func (d *dialect) txnOperation(o *streamload.Output, load *streamload.Load, operation string) error {
+	req := o.NewRequest("PUT", fmt.Sprintf("/api/%s/_stream_load_2pc", load.TargetSchema), nil)
+	if load.TxnId > 0 {
+		req.Header.Add("txn_id", strconv.FormatInt(load.TxnId, 10))
+	} else {
+		req.Header.Add("label", load.Label)
+	}
+	req.Header.Add("txn_operation", operation)
+	returnMap, err := o.Send(req)
+	if err != nil {
+		return err
+	}
+	if returnMap["status"] != "Success" {
+		return errors.Errorf("%s load %s failed, msg: %v", operation, load.Label, returnMap["msg"])
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package kafka
 
 import (
+	"context"
 	"fmt"
 	gokafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/goccy/go-json"
+	"github.com/juju/errors"
 	"github.com/mitchellh/mapstructure"
 	"github.com/siddontang/go-log/log"
 	"github.com/sqlpub/qin-cdc/config"
@@ -25,6 +27,8 @@ type OutputPlugin struct {
 	}
 	client       *gokafka.Producer
 	lastPosition string
+	name         string
+	txnMsgs      []*core.Msg // exactly once, current source transaction msgs
 }
 
 func (o *OutputPlugin) Configure(conf map[string]interface{}) error {
@@ -33,6 +37,18 @@ func (o *OutputPlugin) Configure(conf map[string]interface{}) error {
 	if err := mapstructure.Decode(targetConf, o.KafkaConfig); err != nil {
 		return err
 	}
+	if err := validateConfig(o.KafkaConfig); err != nil {
+		return err
+	}
+	if err := validateRouting(o.KafkaConfig); err != nil {
+		return err
+	}
+	if o.Options.ExactlyOnce && o.Options.TransactionalId == "" {
+		return errors.Errorf("output %s exactly-once requires option transactional-id", PluginName)
+	}
+	if o.Options.TombstonesOnDelete && formatType(o.Options.OutputFormat) != debezium {
+		return errors.Errorf("output %s tombstones-on-delete requires output-format %s", PluginName, debezium)
+	}
 	o.initFormatPlugin(fmt.Sprintf("%v", o.Options.OutputFormat))
 	return nil
 }
@@ -47,12 +63,29 @@ func (o *OutputPlugin) NewOutput(metas *core.Metas) {
 	if o.KafkaConfig.Options.BatchIntervalMs == 0 {
 		o.KafkaConfig.Options.BatchIntervalMs = DefaultBatchIntervalMs
 	}
+	if o.KafkaConfig.Options.PartitionBy == "" {
+		o.KafkaConfig.Options.PartitionBy = string(partitionByPrimaryKey)
+	}
+	if o.KafkaConfig.Options.PartitionBy == string(partitionByColumn) {
+		for _, router := range metas.Routers.Raws {
+			if router.PartitionColumn == "" {
+				log.Fatalf("output %s partition-by %s requires router partition-column, %s.%s", PluginName, partitionByColumn, router.SourceSchema, router.SourceTable)
+			}
+		}
+	}
+	if o.KafkaConfig.Options.CheckpointTopic == "" {
+		o.KafkaConfig.Options.CheckpointTopic = DefaultCheckpointTopic
+	}
 
 	o.msgTxnBuffer.size = 0
 	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
 
 	var err error
-	o.client, err = getProducer(o.KafkaConfig)
+	if o.Options.ExactlyOnce {
+		o.client, err = getTransactionalProducer(o.KafkaConfig)
+	} else {
+		o.client, err = getProducer(o.KafkaConfig)
+	}
 	if err != nil {
 		log.Fatal("output config client failed. err: ", err.Error())
 	}
@@ -70,7 +103,21 @@ func (o *OutputPlugin) Start(out chan *core.Msg, pos core.Position) {
 				switch data.Type {
 				case core.MsgCtl:
 					o.lastPosition = data.InputContext.Pos
+					if o.Options.ExactlyOnce {
+						// only complete source transactions are flushed
+						for _, msg := range o.txnMsgs {
+							o.appendMsgTxnBuffer(msg)
+						}
+						o.txnMsgs = o.txnMsgs[:0]
+						if o.msgTxnBuffer.size >= o.KafkaConfig.Options.BatchSize {
+							o.flushMsgTxnBuffer(pos)
+						}
+					}
 				case core.MsgDML:
+					if o.Options.ExactlyOnce {
+						o.txnMsgs = append(o.txnMsgs, data)
+						continue
+					}
 					o.appendMsgTxnBuffer(data)
 					if o.msgTxnBuffer.size >= o.KafkaConfig.Options.BatchSize {
 						o.flushMsgTxnBuffer(pos)
@@ -129,49 +176,164 @@ func (o *OutputPlugin) flushMsgTxnBuffer(pos core.Position) {
 	if o.msgTxnBuffer.size == 0 {
 		return
 	}
+	if o.Options.ExactlyOnce {
+		// one kafka transaction per flush
+		if err := o.client.BeginTransaction(); err != nil {
+			log.Fatalf("output %s begin transaction err %v", PluginName, err)
+		}
+	}
 	// table level send
 	for k, msgs := range o.msgTxnBuffer.tableMsgMap {
-		// columnsMapper := o.metas.Routers.Maps[k].ColumnsMapper
 		schemaName, tableName, version := metas.SplitMapRouterVersionKey(k)
-		dmlTopic := o.metas.Routers.Maps[metas.GenerateMapRouterKey(schemaName, tableName)].DmlTopic
+		router := o.metas.Routers.Maps[metas.GenerateMapRouterKey(schemaName, tableName)]
 		table, err := o.metas.Input.GetVersion(schemaName, tableName, version)
 		if err != nil {
 			log.Fatalf("get input table meta failed, err: %v", err.Error())
 		}
-		err = o.execute(msgs, table, dmlTopic)
+		err = o.execute(msgs, table, router)
 		if err != nil {
 			log.Fatalf("output %s send err %v", PluginName, err)
 		}
 	}
+	if o.Options.ExactlyOnce {
+		o.commitTransaction()
+	}
 	o.clearMsgTxnBuffer()
 }
 
+// commitTransaction write position to checkpoint topic and commit with the data of this flush
+func (o *OutputPlugin) commitTransaction() {
+	checkpointTopic := o.Options.CheckpointTopic
+	ctlMsg := &core.Msg{Type: core.MsgCtl}
+	ctlMsg.InputContext.Pos = o.lastPosition
+	kMsg := gokafka.Message{
+		TopicPartition: gokafka.TopicPartition{Topic: &checkpointTopic, Partition: 0},
+		Key:            []byte(o.name),
+		Value:          []byte(o.lastPosition),
+		Opaque:         ctlMsg,
+	}
+	err := o.send(&kMsg)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), TransactionTimeout)
+		err = o.client.CommitTransaction(ctx)
+		cancel()
+	}
+	if err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), TransactionTimeout)
+		abortErr := o.client.AbortTransaction(ctx)
+		cancel()
+		if abortErr != nil {
+			log.Errorf("output %s abort transaction err %v", PluginName, abortErr)
+		}
+		log.Fatalf("output %s commit transaction err %v", PluginName, err)
+	}
+}
+
+// LoadCheckpoint exactly once, last committed position of this pipeline in checkpoint topic,
+// every partition is read up to the high watermark queried at start
+func (o *OutputPlugin) LoadCheckpoint(name string) (string, error) {
+	o.name = name
+	if !o.Options.ExactlyOnce {
+		return "", nil
+	}
+	consumer, err := getConsumer(o.KafkaConfig, o.Options.TransactionalId+"-checkpoint")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = consumer.Close()
+	}()
+	checkpointTopic := o.Options.CheckpointTopic
+	metadata, err := consumer.GetMetadata(&checkpointTopic, false, 3000)
+	if err != nil {
+		return "", err
+	}
+	topicMeta, ok := metadata.Topics[checkpointTopic]
+	if !ok || topicMeta.Error.Code() == gokafka.ErrUnknownTopicOrPart {
+		return "", nil
+	}
+	if topicMeta.Error.Code() != gokafka.ErrNoError {
+		return "", topicMeta.Error
+	}
+	highs := make(map[int32]int64)
+	var partitions []gokafka.TopicPartition
+	for _, p := range topicMeta.Partitions {
+		low, high, err := consumer.QueryWatermarkOffsets(checkpointTopic, p.ID, 3000)
+		if err != nil {
+			return "", err
+		}
+		if high <= low {
+			continue
+		}
+		highs[p.ID] = high
+		partitions = append(partitions, gokafka.TopicPartition{Topic: &checkpointTopic, Partition: p.ID, Offset: gokafka.Offset(low)})
+	}
+	if len(partitions) == 0 {
+		return "", nil
+	}
+	err = consumer.Assign(partitions)
+	if err != nil {
+		return "", err
+	}
+	var pos string
+	var posTime time.Time
+	deadline := time.Now().Add(TransactionTimeout)
+	for len(highs) > 0 {
+		m, err := consumer.ReadMessage(time.Second)
+		if err != nil {
+			if kErr, ok := err.(gokafka.Error); !ok || !kErr.IsTimeout() {
+				return "", err
+			}
+		} else if string(m.Key) == name && !m.Timestamp.Before(posTime) {
+			pos = string(m.Value)
+			posTime = m.Timestamp
+		}
+		// position also moves past transaction markers, which are never returned as messages
+		positions, err := consumer.Position(partitions)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range positions {
+			if high, ok := highs[p.Partition]; ok && int64(p.Offset) >= high {
+				delete(highs, p.Partition)
+			}
+		}
+		if len(highs) > 0 && time.Now().After(deadline) {
+			return "", errors.Errorf("read checkpoint topic %s timeout, partitions %v not reach high watermark", checkpointTopic, highs)
+		}
+	}
+	return pos, nil
+}
+
 func (o *OutputPlugin) clearMsgTxnBuffer() {
 	o.msgTxnBuffer.size = 0
 	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
 }
 
-func (o *OutputPlugin) execute(msgs []*core.Msg, table *metas.Table, dmlTopic string) error {
+func (o *OutputPlugin) execute(msgs []*core.Msg, table *metas.Table, router *metas.Router) error {
+	dmlTopic := resolveTopic(router.DmlTopic, table.Schema, table.Name)
+	partitionNum, err := o.getPartitionNum(dmlTopic)
+	if err != nil {
+		return err
+	}
 	for _, msg := range msgs {
-		formatMsg := o.formatInterface.formatMsg(msg, table)
-		bFormatMsg, err := json.Marshal(formatMsg)
+		bFormatMsg, err := o.encodeMsg(msg, table, dmlTopic)
 		if err != nil {
 			return err
 		}
-		pksData, err := GenPrimaryKeys(table.PrimaryKeyColumns, msg.DmlMsg.Data)
+		kKey, err := o.genKey(msg, table)
 		if err != nil {
 			return err
 		}
-		_, dataHash, err := DataHash(pksData)
+		partitionHash, err := o.partitionHash(msg, table, router)
 		if err != nil {
 			return err
 		}
-		kPartition := dataHash % uint64(o.PartitionNum)
-		kKey := strconv.FormatUint(dataHash, 10)
+		kPartition := partitionHash % uint64(partitionNum)
 
 		kMsg := gokafka.Message{
 			TopicPartition: gokafka.TopicPartition{Topic: &dmlTopic, Partition: int32(kPartition)},
-			Key:            []byte(kKey),
+			Key:            kKey,
 			Value:          bFormatMsg,
 			Opaque:         msg,
 		}
@@ -180,6 +342,19 @@ func (o *OutputPlugin) execute(msgs []*core.Msg, table *metas.Table, dmlTopic st
 		if err != nil {
 			return err
 		}
+		if o.Options.TombstonesOnDelete && msg.DmlMsg.Action == core.DeleteAction {
+			// tombstone, null value with the same key, compacted topic removes the key
+			tombstoneMsg := gokafka.Message{
+				TopicPartition: gokafka.TopicPartition{Topic: &dmlTopic, Partition: int32(kPartition)},
+				Key:            kKey,
+				Value:          nil,
+				Opaque:         msg,
+			}
+			err = o.send(&tombstoneMsg)
+			if err != nil {
+				return err
+			}
+		}
 		log.Debugf("output %s msg: %v", PluginName, string(bFormatMsg))
 		// prom write event number counter
 		metrics.OpsWriteProcessed.Add(1)
@@ -187,6 +362,84 @@ func (o *OutputPlugin) execute(msgs []*core.Msg, table *metas.Table, dmlTopic st
 	return nil
 }
 
+// genKey message key, format key first, then key-format option
+func (o *OutputPlugin) genKey(msg *core.Msg, table *metas.Table) ([]byte, error) {
+	if keyFormat, ok := o.formatInterface.(keyFormatInterface); ok {
+		key, err := keyFormat.formatKey(msg, table)
+		if err != nil || key == nil {
+			return nil, err
+		}
+		return json.Marshal(key)
+	}
+	pksData, err := GenPrimaryKeys(table.PrimaryKeyColumns, msg.DmlMsg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if keyFormatType(o.Options.KeyFormat) == jsonKey {
+		return json.Marshal(pksData)
+	}
+	_, dataHash, err := DataHash(pksData)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.FormatUint(dataHash, 10)), nil
+}
+
+func (o *OutputPlugin) partitionHash(msg *core.Msg, table *metas.Table, router *metas.Router) (uint64, error) {
+	var hashData interface{}
+	switch partitionStrategy(o.Options.PartitionBy) {
+	case partitionByTable:
+		hashData = metas.GenerateMapRouterKey(msg.Database, msg.Table)
+	case partitionByColumn:
+		value, ok := msg.DmlMsg.Data[router.PartitionColumn]
+		if !ok {
+			return 0, errors.Errorf("partition column %s not found in %s.%s", router.PartitionColumn, msg.Database, msg.Table)
+		}
+		hashData = map[string]interface{}{router.PartitionColumn: value}
+	case partitionByTransaction:
+		hashData = msg.InputContext.Gtid
+	default:
+		pksData, err := GenPrimaryKeys(table.PrimaryKeyColumns, msg.DmlMsg.Data)
+		if err != nil {
+			return 0, err
+		}
+		hashData = pksData
+	}
+	_, dataHash, err := DataHash(hashData)
+	return dataHash, err
+}
+
+// getPartitionNum topic partition number from topic metadata, partition-num option when metadata is unavailable
+func (o *OutputPlugin) getPartitionNum(topicName string) (int, error) {
+	metaPlugin, ok := o.metas.Output.(*MetaPlugin)
+	if ok {
+		topic, err := metaPlugin.Get(topicName)
+		if err != nil {
+			return 0, err
+		}
+		if topic == nil {
+			topic, err = metaPlugin.LoadTopic(topicName)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if topic.Partition > 0 {
+			return topic.Partition, nil
+		}
+	}
+	if o.PartitionNum > 0 {
+		return o.PartitionNum, nil
+	}
+	return 0, errors.Errorf("topic %s partition number unknown, set option partition-num", topicName)
+}
+
+func (o *OutputPlugin) encodeMsg(msg *core.Msg, table *metas.Table, topic string) ([]byte, error) {
+	if encodeFormat, ok := o.formatInterface.(encodeFormatInterface); ok {
+		return encodeFormat.encodeMsg(msg, table, topic)
+	}
+	return json.Marshal(o.formatInterface.formatMsg(msg, table))
+}
+
 func (o *OutputPlugin) send(message *gokafka.Message) error {
 	var err error
 	for i := 0; i < RetryCount; i++ {
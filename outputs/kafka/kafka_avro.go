@@ -0,0 +1,315 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	avroNamespacePrefix = "qin_cdc"
+	avroMagicByte       = byte(0)
+)
+
+var avroInvalidNameChar = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+type avroFormat struct {
+	registry *schemaRegistryClient
+	strategy subjectNameStrategy
+	schemas  map[string]*avroTableSchema // key: topic + table version key
+}
+
+type avroField struct {
+	name     string // row data column name
+	avroName string
+	avroType string // avro primitive type, always nullable
+}
+
+type avroTableSchema struct {
+	id       int
+	fullName string
+	fields   []avroField
+}
+
+func newAvroFormat(registryUrl string, userName string, password string, strategy string) *avroFormat {
+	if registryUrl == "" {
+		log.Fatalf("output format %s requires option schema-registry-url", avro)
+	}
+	if strategy == "" {
+		strategy = string(topicRecordNameStrategy)
+	}
+	if _, err := subjectName(subjectNameStrategy(strategy), "", ""); err != nil {
+		log.Fatal(err)
+	}
+	return &avroFormat{
+		registry: newSchemaRegistryClient(registryUrl, userName, password),
+		strategy: subjectNameStrategy(strategy),
+		schemas:  make(map[string]*avroTableSchema),
+	}
+}
+
+// formatMsg avro datum, same layout as default json format
+func (af *avroFormat) formatMsg(event *core.Msg, table *metas.Table) interface{} {
+	return &kafkaDefaultMsg{
+		Database: event.Database,
+		Table:    event.Table,
+		Type:     event.DmlMsg.Action,
+		Ts:       uint32(event.Timestamp.Unix()),
+		Data:     event.DmlMsg.Data,
+		Old:      event.DmlMsg.Old,
+	}
+}
+
+// encodeMsg confluent wire format: magic byte, 4 bytes schema id, avro binary datum
+func (af *avroFormat) encodeMsg(event *core.Msg, table *metas.Table, topic string) ([]byte, error) {
+	tableSchema, err := af.getSchema(event, table, topic)
+	if err != nil {
+		return nil, err
+	}
+	kMsg := af.formatMsg(event, table).(*kafkaDefaultMsg)
+	buf := make([]byte, 0, 256)
+	buf = append(buf, avroMagicByte)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(tableSchema.id))
+	buf = avroAppendString(buf, kMsg.Database)
+	buf = avroAppendString(buf, kMsg.Table)
+	buf = avroAppendString(buf, string(kMsg.Type))
+	buf = avroAppendLong(buf, int64(kMsg.Ts))
+	for _, row := range []map[string]interface{}{kMsg.Data, kMsg.Old} {
+		if row == nil {
+			buf = avroAppendLong(buf, 0) // union index null
+			continue
+		}
+		buf = avroAppendLong(buf, 1) // union index row record
+		for _, field := range tableSchema.fields {
+			buf, err = avroAppendNullable(buf, field.avroType, row[field.name])
+			if err != nil {
+				return nil, errors.Errorf("avro encode %s.%s column %s failed, err: %v", event.Database, event.Table, field.name, err)
+			}
+		}
+	}
+	return buf, nil
+}
+
+// getSchema table version schema, registered on first use, a new table version after ddl registers a new schema version
+func (af *avroFormat) getSchema(event *core.Msg, table *metas.Table, topic string) (*avroTableSchema, error) {
+	key := topic + metas.MapRouterKeyDelimiter + metas.GenerateMapRouterVersionKey(event.Database, event.Table, event.DmlMsg.TableVersion)
+	if tableSchema, ok := af.schemas[key]; ok {
+		return tableSchema, nil
+	}
+	row := event.DmlMsg.Data
+	if row == nil {
+		row = event.DmlMsg.Old
+	}
+	tableSchema := &avroTableSchema{}
+	for _, column := range rowColumns(row, table) {
+		tableSchema.fields = append(tableSchema.fields, avroField{
+			name:     column.Name,
+			avroName: avroName(column.Name),
+			avroType: avroColumnType(column),
+		})
+	}
+	schema, fullName, err := af.buildSchema(event, tableSchema.fields)
+	if err != nil {
+		return nil, err
+	}
+	tableSchema.fullName = fullName
+	subject, err := subjectName(af.strategy, topic, fullName)
+	if err != nil {
+		return nil, err
+	}
+	tableSchema.id, err = af.registry.register(subject, schema)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("output %s registered avro schema, subject: %s, id: %d", PluginName, subject, tableSchema.id)
+	af.schemas[key] = tableSchema
+	return tableSchema, nil
+}
+
+func (af *avroFormat) buildSchema(event *core.Msg, fields []avroField) (schema string, fullName string, err error) {
+	namespace := strings.Join([]string{avroNamespacePrefix, avroName(event.Database), avroName(event.Table)}, ".")
+	rowFields := make([]map[string]interface{}, 0, len(fields))
+	for _, field := range fields {
+		rowFields = append(rowFields, map[string]interface{}{
+			"name":    field.avroName,
+			"type":    []string{"null", field.avroType},
+			"default": nil,
+		})
+	}
+	envelope := map[string]interface{}{
+		"type":      "record",
+		"name":      "Envelope",
+		"namespace": namespace,
+		"fields": []interface{}{
+			map[string]interface{}{"name": "database", "type": "string"},
+			map[string]interface{}{"name": "table", "type": "string"},
+			map[string]interface{}{"name": "type", "type": "string"},
+			map[string]interface{}{"name": "ts", "type": "long"},
+			map[string]interface{}{
+				"name": "data",
+				"type": []interface{}{"null", map[string]interface{}{
+					"type":   "record",
+					"name":   "Value",
+					"fields": rowFields,
+				}},
+				"default": nil,
+			},
+			map[string]interface{}{"name": "old", "type": []string{"null", "Value"}, "default": nil},
+		},
+	}
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		return "", "", err
+	}
+	return string(b), namespace + ".Envelope", nil
+}
+
+func avroName(name string) string {
+	name = avroInvalidNameChar.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func avroColumnType(column metas.Column) string {
+	switch column.Type {
+	case metas.TypeNumber:
+		rawType := strings.ToLower(column.RawType)
+		if strings.HasPrefix(rawType, "bigint") && strings.Contains(rawType, "unsigned") {
+			// bigint unsigned exceeds long, decimal text
+			return "string"
+		}
+		return "long"
+	case metas.TypeEnum, metas.TypeSet, metas.TypeBit: // binlog value is integer, index or bitmap
+		return "long"
+	case metas.TypeFloat: // float, double
+		if strings.HasPrefix(column.RawType, "float") {
+			return "float"
+		}
+		return "double"
+	case metas.TypeDecimal: // binlog decimal value is float64
+		return "double"
+	case metas.TypeBinary:
+		if column.RawType == "text" {
+			return "string"
+		}
+		return "bytes"
+	default: // string, json, datetime, timestamp, date, time
+		return "string"
+	}
+}
+
+func avroAppendNullable(buf []byte, avroType string, value interface{}) ([]byte, error) {
+	if value == nil {
+		return avroAppendLong(buf, 0), nil // union index null
+	}
+	buf = avroAppendLong(buf, 1)
+	switch avroType {
+	case "long":
+		v, err := avroToInt64(value)
+		if err != nil {
+			return nil, err
+		}
+		return avroAppendLong(buf, v), nil
+	case "float", "double":
+		v, err := avroToFloat64(value)
+		if err != nil {
+			return nil, err
+		}
+		if avroType == "float" {
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v))), nil
+		}
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v)), nil
+	case "bytes":
+		if b, ok := value.([]byte); ok {
+			return avroAppendBytes(buf, b), nil
+		}
+		return avroAppendString(buf, fmt.Sprintf("%v", value)), nil
+	default:
+		if b, ok := value.([]byte); ok {
+			return avroAppendBytes(buf, b), nil
+		}
+		return avroAppendString(buf, fmt.Sprintf("%v", value)), nil
+	}
+}
+
+func avroToInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, errors.Errorf("value %v overflows long", value)
+		}
+		return int64(v), nil
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return 0, errors.Errorf("value %v overflows long", value)
+		}
+		return int64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, errors.Errorf("value %v type %T can not convert to long", value, value)
+	}
+}
+
+func avroToFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		i, err := avroToInt64(value)
+		if err != nil {
+			return 0, errors.Errorf("value %v type %T can not convert to double", value, value)
+		}
+		return float64(i), nil
+	}
+}
+
+// avroAppendLong zigzag varint encoding, also used for int, union index and length
+func avroAppendLong(buf []byte, v int64) []byte {
+	return binary.AppendUvarint(buf, uint64((v<<1)^(v>>63)))
+}
+
+func avroAppendBytes(buf []byte, b []byte) []byte {
+	buf = avroAppendLong(buf, int64(len(b)))
+	return append(buf, b...)
+}
+
+func avroAppendString(buf []byte, s string) []byte {
+	buf = avroAppendLong(buf, int64(len(s)))
+	return append(buf, s...)
+}
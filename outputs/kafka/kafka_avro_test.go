@@ -0,0 +1,202 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"github.com/goccy/go-json"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry schema registry stand-in, same schema gets the same id
+type testRegistry struct {
+	mu       sync.Mutex
+	ids      map[string]int
+	subjects []string
+	schemas  []string
+	auth     string
+}
+
+func newTestRegistry(t *testing.T) (*testRegistry, *httptest.Server) {
+	registry := &testRegistry{ids: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, ok := strings.CutPrefix(r.URL.EscapedPath(), "/subjects/")
+		subject, ok2 := strings.CutSuffix(subject, "/versions")
+		if r.Method != "POST" || !ok || !ok2 {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Content-Type") != schemaRegistryContentType {
+			http.Error(w, "content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		subject, _ = url.PathUnescape(subject)
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Schema string `json:"schema"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		registry.auth = r.Header.Get("Authorization")
+		id, ok := registry.ids[req.Schema]
+		if !ok {
+			id = len(registry.ids) + 1
+			registry.ids[req.Schema] = id
+		}
+		registry.subjects = append(registry.subjects, subject)
+		registry.schemas = append(registry.schemas, req.Schema)
+		_, _ = w.Write([]byte(`{"id":` + strconv.Itoa(id) + `}`))
+	}))
+	t.Cleanup(server.Close)
+	return registry, server
+}
+
+func testAvroTable(version uint, extraColumns ...metas.Column) *metas.Table {
+	table := &metas.Table{Schema: "db", Name: "orders", Version: version, Columns: []metas.Column{
+		{Name: "id", Type: metas.TypeNumber, RawType: "bigint(20) UNSIGNED", IsPrimaryKey: true},
+		{Name: "name", Type: metas.TypeString, RawType: "varchar(20)"},
+	}}
+	table.Columns = append(table.Columns, extraColumns...)
+	table.PrimaryKeyColumns = table.Columns[:1]
+	return table
+}
+
+func testAvroMsg(table *metas.Table, data map[string]interface{}) *core.Msg {
+	return &core.Msg{Database: table.Schema, Table: table.Name, Type: core.MsgDML,
+		DmlMsg: &core.DMLMsg{Action: core.InsertAction, Data: data, TableVersion: table.Version}}
+}
+
+func TestAvroSubjectNameStrategy(t *testing.T) {
+	tests := []struct {
+		strategy subjectNameStrategy
+		subject  string
+	}{
+		{topicNameStrategy, "orders-topic-value"},
+		{recordNameStrategy, "qin_cdc.db.orders.Envelope"},
+		{topicRecordNameStrategy, "orders-topic-qin_cdc.db.orders.Envelope"},
+		{"", "orders-topic-qin_cdc.db.orders.Envelope"},
+	}
+	for _, tt := range tests {
+		registry, server := newTestRegistry(t)
+		af := newAvroFormat(server.URL+"/", "user", "secret", string(tt.strategy))
+		table := testAvroTable(1)
+		if _, err := af.encodeMsg(testAvroMsg(table, map[string]interface{}{"id": uint64(1), "name": "a"}), table, "orders-topic"); err != nil {
+			t.Fatalf("strategy %q: %v", tt.strategy, err)
+		}
+		if len(registry.subjects) != 1 || registry.subjects[0] != tt.subject {
+			t.Errorf("strategy %q subjects = %v, want %s", tt.strategy, registry.subjects, tt.subject)
+		}
+		if registry.auth != "Basic dXNlcjpzZWNyZXQ=" {
+			t.Errorf("strategy %q authorization = %q", tt.strategy, registry.auth)
+		}
+	}
+	if _, err := subjectName("unknown", "t", "r"); err == nil {
+		t.Errorf("unknown strategy: expected error")
+	}
+}
+
+func TestAvroWireFormat(t *testing.T) {
+	_, server := newTestRegistry(t)
+	af := newAvroFormat(server.URL, "", "", string(topicNameStrategy))
+	table := testAvroTable(1)
+	msg := testAvroMsg(table, map[string]interface{}{"id": uint64(math.MaxUint64), "name": nil})
+	buf, err := af.encodeMsg(msg, table, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != avroMagicByte {
+		t.Fatalf("magic byte = %d", buf[0])
+	}
+	if id := binary.BigEndian.Uint32(buf[1:5]); id != 1 {
+		t.Fatalf("schema id = %d, want 1", id)
+	}
+	d := &avroDecoder{buf: buf[5:]}
+	if db, tb, typ := d.string(), d.string(), d.string(); db != "db" || tb != "orders" || typ != "insert" {
+		t.Fatalf("envelope = %s %s %s", db, tb, typ)
+	}
+	d.long() // ts
+	if d.long() != 1 {
+		t.Fatalf("data is null")
+	}
+	// bigint unsigned is a nullable string, beyond long
+	if d.long() != 1 || d.string() != "18446744073709551615" {
+		t.Errorf("id not encoded as unsigned decimal text")
+	}
+	if d.long() != 0 {
+		t.Errorf("null name not encoded as union null")
+	}
+	if d.long() != 0 || len(d.buf) != 0 {
+		t.Errorf("old not encoded as union null, %d bytes left", len(d.buf))
+	}
+}
+
+func TestAvroSchemaEvolution(t *testing.T) {
+	registry, server := newTestRegistry(t)
+	af := newAvroFormat(server.URL, "", "", string(topicNameStrategy))
+	v1 := testAvroTable(1)
+	v2 := testAvroTable(2, metas.Column{Name: "amount", Type: metas.TypeFloat, RawType: "double"})
+	encode := func(table *metas.Table, data map[string]interface{}) uint32 {
+		buf, err := af.encodeMsg(testAvroMsg(table, data), table, "orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return binary.BigEndian.Uint32(buf[1:5])
+	}
+	id1 := encode(v1, map[string]interface{}{"id": uint64(1), "name": "a"})
+	// alter table add column, new table version registers a new schema version
+	id2 := encode(v2, map[string]interface{}{"id": uint64(2), "name": "b", "amount": 1.5})
+	// rows of the old version still in flight keep the old schema, no new registration
+	id3 := encode(v1, map[string]interface{}{"id": uint64(3), "name": "c"})
+	if id1 == id2 || id3 != id1 {
+		t.Errorf("schema ids = %d, %d, %d", id1, id2, id3)
+	}
+	if len(registry.schemas) != 2 || registry.subjects[0] != registry.subjects[1] {
+		t.Fatalf("registrations = %v", registry.subjects)
+	}
+	if strings.Contains(registry.schemas[0], `"amount"`) || !strings.Contains(registry.schemas[1], `"amount"`) {
+		t.Errorf("added column not in new schema version")
+	}
+	// added field is nullable with default null, backward compatible
+	if !strings.Contains(registry.schemas[1], `{"default":null,"name":"amount","type":["null","double"]}`) {
+		t.Errorf("added field schema: %s", registry.schemas[1])
+	}
+}
+
+func TestAvroToInt64Overflow(t *testing.T) {
+	if _, err := avroToInt64(uint64(math.MaxInt64) + 1); err == nil {
+		t.Errorf("uint64 over max int64: expected error")
+	}
+	if v, err := avroToInt64(uint64(math.MaxInt64)); err != nil || v != math.MaxInt64 {
+		t.Errorf("max int64 = %d, %v", v, err)
+	}
+}
+
+// avroDecoder reads avro binary primitives of encoded datums
+type avroDecoder struct {
+	buf []byte
+}
+
+func (d *avroDecoder) long() int64 {
+	u, n := binary.Uvarint(d.buf)
+	d.buf = d.buf[n:]
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (d *avroDecoder) string() string {
+	n := d.long()
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
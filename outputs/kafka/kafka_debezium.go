@@ -0,0 +1,394 @@
+package kafka
+
+import (
+	"fmt"
+	"github.com/go-demo/version"
+	"github.com/goccy/go-json"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	debeziumConnector   = "mysql"
+	debeziumDecimalName = "org.apache.kafka.connect.data.Decimal"
+
+	defaultDecimalPrecision = 10
+)
+
+var decimalTypeArgs = regexp.MustCompile(`\((\d+)(?:\s*,\s*(\d+))?\)`)
+
+type debeziumFormat struct {
+	serverName    string
+	schemasEnable bool
+	decimalMode   decimalHandlingMode
+}
+
+type debeziumSchema struct {
+	Type       string            `json:"type"`
+	Optional   bool              `json:"optional"`
+	Name       string            `json:"name,omitempty"`
+	Version    int               `json:"version,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Field      string            `json:"field,omitempty"`
+	Fields     []debeziumSchema  `json:"fields,omitempty"`
+}
+
+type debeziumMsg struct {
+	Schema  *debeziumSchema `json:"schema"`
+	Payload interface{}     `json:"payload"`
+}
+
+type debeziumPayload struct {
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Source debeziumSource         `json:"source"`
+	Op     string                 `json:"op"`
+	TsMs   int64                  `json:"ts_ms"`
+}
+
+type debeziumSource struct {
+	Version   string  `json:"version"`
+	Connector string  `json:"connector"`
+	Name      string  `json:"name"`
+	TsMs      int64   `json:"ts_ms"`
+	Snapshot  string  `json:"snapshot"`
+	Db        string  `json:"db"`
+	Table     string  `json:"table"`
+	ServerId  uint32  `json:"server_id"`
+	Gtid      *string `json:"gtid"`
+	File      string  `json:"file"`
+	Pos       uint32  `json:"pos"`
+}
+
+func newDebeziumFormat(serverName string, schemasEnable bool, decimalMode string) *debeziumFormat {
+	if serverName == "" {
+		serverName = DefaultDebeziumServerName
+	}
+	switch decimalHandlingMode(decimalMode) {
+	case "":
+		decimalMode = string(decimalPrecise)
+	case decimalPrecise, decimalString, decimalDouble:
+	default:
+		log.Fatalf("output %s unknown debezium-decimal-handling-mode: %s, support %s, %s, %s",
+			PluginName, decimalMode, decimalPrecise, decimalString, decimalDouble)
+	}
+	return &debeziumFormat{serverName: serverName, schemasEnable: schemasEnable, decimalMode: decimalHandlingMode(decimalMode)}
+}
+
+func (df *debeziumFormat) formatMsg(event *core.Msg, table *metas.Table) interface{} {
+	msg, err := df.format(event, table)
+	if err != nil {
+		log.Fatalf("output %s debezium format %s.%s err %v", PluginName, event.Database, event.Table, err)
+	}
+	return msg
+}
+
+// encodeMsg debezium json, a decimal value that can not be converted fails the send
+func (df *debeziumFormat) encodeMsg(event *core.Msg, table *metas.Table, topic string) ([]byte, error) {
+	msg, err := df.format(event, table)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(msg)
+}
+
+func (df *debeziumFormat) format(event *core.Msg, table *metas.Table) (interface{}, error) {
+	payload := &debeziumPayload{
+		Source: df.source(event),
+		Op:     debeziumOp(event.DmlMsg.Action),
+		TsMs:   time.Now().UnixMilli(),
+	}
+	var before, after map[string]interface{}
+	switch event.DmlMsg.Action {
+	case core.DeleteAction:
+		before = event.DmlMsg.Data
+	case core.UpdateAction:
+		before = event.DmlMsg.Old
+		after = event.DmlMsg.Data
+	default:
+		after = event.DmlMsg.Data
+	}
+	var err error
+	if payload.Before, err = df.convertRow(before, table); err != nil {
+		return nil, err
+	}
+	if payload.After, err = df.convertRow(after, table); err != nil {
+		return nil, err
+	}
+	if !df.schemasEnable {
+		return payload, nil
+	}
+	return &debeziumMsg{Schema: df.envelopeSchema(event, table), Payload: payload}, nil
+}
+
+// convertRow decimal values by decimal handling mode, row is copied if any value is converted
+func (df *debeziumFormat) convertRow(row map[string]interface{}, table *metas.Table) (map[string]interface{}, error) {
+	if row == nil || df.decimalMode == decimalDouble {
+		return row, nil
+	}
+	converted := row
+	copied := false
+	for _, column := range table.Columns {
+		value, ok := row[column.Name]
+		if column.Type != metas.TypeDecimal || !ok || value == nil {
+			continue
+		}
+		newValue, err := df.decimalValue(value, column)
+		if err != nil {
+			return nil, errors.Errorf("column %s %v", column.Name, err)
+		}
+		if !copied {
+			converted = make(map[string]interface{}, len(row))
+			for k, v := range row {
+				converted[k] = v
+			}
+			copied = true
+		}
+		converted[column.Name] = newValue
+	}
+	return converted, nil
+}
+
+// decimalValue precise mode two's complement big endian bytes of the unscaled value, json encodes bytes as base64,
+// string mode text with column scale. binlog decimal value is float64, exact up to 15 significant digits
+func (df *debeziumFormat) decimalValue(value interface{}, column metas.Column) (interface{}, error) {
+	_, scale := decimalPrecisionScale(column.RawType)
+	var text string
+	switch v := value.(type) {
+	case float64:
+		text = strconv.FormatFloat(v, 'f', scale, 64)
+	case float32:
+		text = strconv.FormatFloat(float64(v), 'f', scale, 32)
+	case []byte:
+		text = string(v)
+	case fmt.Stringer: // decimal.Decimal
+		text = v.String()
+	default:
+		text = fmt.Sprintf("%v", v)
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(text))
+	if !ok {
+		return nil, errors.Errorf("value %v type %T is not a decimal", value, value)
+	}
+	if df.decimalMode == decimalString {
+		return r.FloatString(scale), nil
+	}
+	unscaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	// round half away from zero, as mysql
+	n, rem := new(big.Int).QuoRem(unscaled.Num(), unscaled.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(unscaled.Denom()) >= 0 {
+		n.Add(n, big.NewInt(int64(unscaled.Sign())))
+	}
+	return twosComplementBytes(n), nil
+}
+
+func twosComplementBytes(n *big.Int) []byte {
+	if n.Sign() >= 0 {
+		b := n.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+	// 2^(8*l) + n, l bytes leave room for the sign bit
+	l := (n.BitLen() + 8) / 8
+	m := new(big.Int).Lsh(big.NewInt(1), uint(l*8))
+	return m.Add(m, n).Bytes()
+}
+
+// decimalPrecisionScale precision and scale of decimal(p,s) raw type, decimal is decimal(10,0)
+func decimalPrecisionScale(rawType string) (int, int) {
+	matches := decimalTypeArgs.FindStringSubmatch(rawType)
+	if matches == nil {
+		return defaultDecimalPrecision, 0
+	}
+	precision, _ := strconv.Atoi(matches[1])
+	scale, _ := strconv.Atoi(matches[2])
+	return precision, scale
+}
+
+// formatKey debezium key, primary key columns struct, nil if table has no primary key
+func (df *debeziumFormat) formatKey(event *core.Msg, table *metas.Table) (interface{}, error) {
+	if len(table.PrimaryKeyColumns) == 0 {
+		return nil, nil
+	}
+	pksData, err := GenPrimaryKeys(table.PrimaryKeyColumns, event.DmlMsg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if pksData, err = df.convertRow(pksData, table); err != nil {
+		return nil, err
+	}
+	if !df.schemasEnable {
+		return pksData, nil
+	}
+	keySchema := &debeziumSchema{
+		Type: "struct",
+		Name: df.schemaName(event, "Key"),
+	}
+	for _, column := range table.PrimaryKeyColumns {
+		field := df.columnSchema(column)
+		field.Field = column.Name
+		field.Optional = false
+		keySchema.Fields = append(keySchema.Fields, field)
+	}
+	return &debeziumMsg{Schema: keySchema, Payload: pksData}, nil
+}
+
+func (df *debeziumFormat) source(event *core.Msg) debeziumSource {
+	source := debeziumSource{
+		Version:   version.Version,
+		Connector: debeziumConnector,
+		Name:      df.serverName,
+		TsMs:      event.Timestamp.UnixMilli(),
+		Snapshot:  "false",
+		Db:        event.Database,
+		Table:     event.Table,
+		ServerId:  event.InputContext.ServerId,
+		File:      event.InputContext.LogName,
+		Pos:       event.InputContext.LogPos,
+	}
+	if event.InputContext.Gtid != "" {
+		gtid := event.InputContext.Gtid
+		source.Gtid = &gtid
+	}
+	return source
+}
+
+func (df *debeziumFormat) schemaName(event *core.Msg, suffix string) string {
+	return strings.Join([]string{df.serverName, event.Database, event.Table, suffix}, ".")
+}
+
+func (df *debeziumFormat) envelopeSchema(event *core.Msg, table *metas.Table) *debeziumSchema {
+	valueSchema := df.valueSchema(event, table)
+	before := valueSchema
+	before.Field = "before"
+	after := valueSchema
+	after.Field = "after"
+	return &debeziumSchema{
+		Type: "struct",
+		Name: df.schemaName(event, "Envelope"),
+		Fields: []debeziumSchema{
+			before,
+			after,
+			debeziumSourceSchema(),
+			{Type: "string", Field: "op"},
+			{Type: "int64", Optional: true, Field: "ts_ms"},
+		},
+	}
+}
+
+func (df *debeziumFormat) valueSchema(event *core.Msg, table *metas.Table) debeziumSchema {
+	row := event.DmlMsg.Data
+	valueSchema := debeziumSchema{
+		Type:     "struct",
+		Optional: true,
+		Name:     df.schemaName(event, "Value"),
+	}
+	for _, column := range rowColumns(row, table) {
+		field := df.columnSchema(column)
+		field.Field = column.Name
+		valueSchema.Fields = append(valueSchema.Fields, field)
+	}
+	return valueSchema
+}
+
+func debeziumSourceSchema() debeziumSchema {
+	return debeziumSchema{
+		Type:  "struct",
+		Name:  "io.debezium.connector.mysql.Source",
+		Field: "source",
+		Fields: []debeziumSchema{
+			{Type: "string", Field: "version"},
+			{Type: "string", Field: "connector"},
+			{Type: "string", Field: "name"},
+			{Type: "int64", Field: "ts_ms"},
+			{Type: "string", Optional: true, Field: "snapshot"},
+			{Type: "string", Field: "db"},
+			{Type: "string", Optional: true, Field: "table"},
+			{Type: "int64", Field: "server_id"},
+			{Type: "string", Optional: true, Field: "gtid"},
+			{Type: "string", Field: "file"},
+			{Type: "int64", Field: "pos"},
+		},
+	}
+}
+
+func (df *debeziumFormat) columnSchema(column metas.Column) debeziumSchema {
+	schema := debeziumSchema{Optional: !column.IsPrimaryKey}
+	switch column.Type {
+	case metas.TypeNumber: // tinyint, smallint, mediumint, int, bigint, year
+		// debezium types hold the unsigned range: smallint unsigned int32, int unsigned int64
+		rawType := strings.ToLower(column.RawType)
+		unsigned := strings.Contains(rawType, "unsigned")
+		switch {
+		case strings.HasPrefix(rawType, "year"):
+			schema.Type = "int32"
+			schema.Name = "io.debezium.time.Year"
+		case strings.HasPrefix(rawType, "bigint"), strings.HasPrefix(rawType, "int") && unsigned:
+			schema.Type = "int64"
+		case strings.HasPrefix(rawType, "smallint") && unsigned:
+			schema.Type = "int32"
+		case strings.HasPrefix(rawType, "tinyint"), strings.HasPrefix(rawType, "smallint"):
+			schema.Type = "int16"
+		default: // mediumint, mediumint unsigned, int
+			schema.Type = "int32"
+		}
+	case metas.TypeFloat: // float, double
+		if strings.HasPrefix(column.RawType, "float") {
+			schema.Type = "float"
+		} else {
+			schema.Type = "double"
+		}
+	case metas.TypeDecimal:
+		switch df.decimalMode {
+		case decimalPrecise:
+			precision, scale := decimalPrecisionScale(column.RawType)
+			schema.Type = "bytes"
+			schema.Name = debeziumDecimalName
+			schema.Version = 1
+			schema.Parameters = map[string]string{
+				"scale":                     strconv.Itoa(scale),
+				"connect.decimal.precision": strconv.Itoa(precision),
+			}
+		case decimalString:
+			schema.Type = "string"
+		default:
+			schema.Type = "double"
+		}
+	case metas.TypeEnum, metas.TypeSet, metas.TypeBit: // binlog value is index or bitmap
+		schema.Type = "int64"
+	case metas.TypeJson:
+		schema.Type = "string"
+		schema.Name = "io.debezium.data.Json"
+	case metas.TypeBinary:
+		if column.RawType == "text" {
+			schema.Type = "string"
+		} else {
+			schema.Type = "bytes"
+		}
+	default: // string, datetime, timestamp, date, time
+		schema.Type = "string"
+	}
+	return schema
+}
+
+func debeziumOp(action core.ActionType) string {
+	switch action {
+	case core.InsertAction:
+		return "c"
+	case core.UpdateAction, core.ReplaceAction:
+		return "u"
+	case core.DeleteAction:
+		return "d"
+	default:
+		return fmt.Sprintf("%v", action)
+	}
+}
@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"bytes"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"testing"
+)
+
+func TestDebeziumDecimalValue(t *testing.T) {
+	column := metas.Column{Name: "amount", Type: metas.TypeDecimal, RawType: "decimal(10,2)"}
+	tests := []struct {
+		value   interface{}
+		precise []byte
+		text    string
+	}{
+		{value: 12.34, precise: []byte{0x04, 0xd2}, text: "12.34"},
+		{value: -12.34, precise: []byte{0xfb, 0x2e}, text: "-12.34"},
+		{value: 1.005, precise: []byte{0x64}, text: "1.00"}, // float64 1.005 is 1.00499...
+		{value: "1.005", precise: []byte{0x65}, text: "1.01"},
+		{value: 1.28, precise: []byte{0x00, 0x80}, text: "1.28"},
+		{value: float64(0), precise: []byte{0x00}, text: "0.00"},
+	}
+	precise := newDebeziumFormat("", false, string(decimalPrecise))
+	str := newDebeziumFormat("", false, string(decimalString))
+	for _, tt := range tests {
+		got, err := precise.decimalValue(tt.value, column)
+		if err != nil {
+			t.Fatalf("precise %v: %v", tt.value, err)
+		}
+		if !bytes.Equal(got.([]byte), tt.precise) {
+			t.Errorf("precise %v = %x, want %x", tt.value, got, tt.precise)
+		}
+		got, err = str.decimalValue(tt.value, column)
+		if err != nil {
+			t.Fatalf("string %v: %v", tt.value, err)
+		}
+		if got != tt.text {
+			t.Errorf("string %v = %v, want %v", tt.value, got, tt.text)
+		}
+	}
+	if _, err := precise.decimalValue("abc", column); err == nil {
+		t.Errorf("precise abc: expected error")
+	}
+}
+
+func TestDebeziumDecimalSchema(t *testing.T) {
+	column := metas.Column{Name: "amount", Type: metas.TypeDecimal, RawType: "decimal(30,4)"}
+	schema := newDebeziumFormat("", true, "").columnSchema(column)
+	if schema.Type != "bytes" || schema.Name != debeziumDecimalName || schema.Version != 1 {
+		t.Fatalf("precise schema = %+v", schema)
+	}
+	if schema.Parameters["scale"] != "4" || schema.Parameters["connect.decimal.precision"] != "30" {
+		t.Errorf("precise schema parameters = %v", schema.Parameters)
+	}
+	if schema = newDebeziumFormat("", true, string(decimalString)).columnSchema(column); schema.Type != "string" {
+		t.Errorf("string schema type = %s", schema.Type)
+	}
+	if schema = newDebeziumFormat("", true, string(decimalDouble)).columnSchema(column); schema.Type != "double" {
+		t.Errorf("double schema type = %s", schema.Type)
+	}
+}
+
+func TestDebeziumIntegerSchema(t *testing.T) {
+	tests := []struct {
+		rawType string
+		typ     string
+	}{
+		{"tinyint(4)", "int16"},
+		{"tinyint(3) unsigned", "int16"},
+		{"smallint(6)", "int16"},
+		{"smallint(5) unsigned", "int32"}, // 65535 overflows int16
+		{"mediumint(9)", "int32"},
+		{"mediumint(8) unsigned", "int32"},
+		{"int(11)", "int32"},
+		{"int(10) unsigned", "int64"},
+		{"INT UNSIGNED", "int64"},
+		{"bigint(20)", "int64"},
+		{"bigint(20) unsigned", "int64"},
+		{"year(4)", "int32"},
+	}
+	df := newDebeziumFormat("", true, "")
+	for _, tt := range tests {
+		column := metas.Column{Name: "n", Type: metas.TypeNumber, RawType: tt.rawType}
+		if schema := df.columnSchema(column); schema.Type != tt.typ {
+			t.Errorf("%s schema type = %s, want %s", tt.rawType, schema.Type, tt.typ)
+		}
+	}
+}
+
+func TestDebeziumFormatKeepsRow(t *testing.T) {
+	table := &metas.Table{Schema: "db", Name: "t", Columns: []metas.Column{
+		{Name: "id", Type: metas.TypeNumber, RawType: "int(11)", IsPrimaryKey: true},
+		{Name: "amount", Type: metas.TypeDecimal, RawType: "decimal(10,2)"},
+	}}
+	table.PrimaryKeyColumns = table.Columns[:1]
+	data := map[string]interface{}{"id": int32(1), "amount": 12.34}
+	msg := &core.Msg{Database: "db", Table: "t", Type: core.MsgDML,
+		DmlMsg: &core.DMLMsg{Action: core.InsertAction, Data: data}}
+	payload := newDebeziumFormat("", false, string(decimalString)).formatMsg(msg, table).(*debeziumPayload)
+	if payload.After["amount"] != "12.34" || payload.Op != "c" {
+		t.Errorf("payload after = %v, op = %s", payload.After, payload.Op)
+	}
+	// row shared by other formats and transforms is not changed
+	if data["amount"] != 12.34 {
+		t.Errorf("row data changed: %v", data)
+	}
+}
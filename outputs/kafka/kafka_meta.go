@@ -26,6 +26,9 @@ func (m *MetaPlugin) Configure(conf map[string]interface{}) error {
 	if err := mapstructure.Decode(target, m.KafkaConfig); err != nil {
 		return err
 	}
+	if err := validateConfig(m.KafkaConfig); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -37,23 +40,42 @@ func (m *MetaPlugin) LoadMeta(routers []*metas.Router) (err error) {
 	}
 	for _, router := range routers {
 		dmlTopic := router.DmlTopic
-		if ok := m.topics[dmlTopic]; ok != nil {
-			m.topics[dmlTopic].Name = dmlTopic
-			metadata, err := m.producer.GetMetadata(&dmlTopic, false, 3000)
-			if err != nil {
-				return err
-			}
-			m.topics[dmlTopic].Partition = len(metadata.Topics[dmlTopic].Partitions)
+		if isTopicTemplate(dmlTopic) {
+			// resolved and loaded on first send
+			continue
+		}
+		if _, ok := m.topics[dmlTopic]; ok {
+			continue
+		}
+		_, err = m.LoadTopic(dmlTopic)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// LoadTopic get topic partition number from broker metadata
+func (m *MetaPlugin) LoadTopic(topicName string) (topic *Topic, err error) {
+	metadata, err := m.producer.GetMetadata(&topicName, false, 3000)
+	if err != nil {
+		return nil, err
+	}
+	topic = &Topic{Name: topicName, Partition: len(metadata.Topics[topicName].Partitions)}
+	err = m.Add(topic)
+	if err != nil {
+		return nil, err
+	}
+	return topic, nil
+}
+
 func (m *MetaPlugin) GetMeta(router *metas.Router) (topic interface{}, err error) {
 	return m.Get(router.DmlTopic)
 }
 
 func (m *MetaPlugin) Get(topicName string) (topic *Topic, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.topics[topicName], err
 }
 
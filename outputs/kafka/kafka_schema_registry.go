@@ -0,0 +1,111 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type subjectNameStrategy string
+
+const (
+	topicNameStrategy       subjectNameStrategy = "topic-name"        // <topic>-value
+	recordNameStrategy      subjectNameStrategy = "record-name"       // <record full name>
+	topicRecordNameStrategy subjectNameStrategy = "topic-record-name" // <topic>-<record full name>
+
+	schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+)
+
+// schemaRegistryClient confluent compatible schema registry client
+type schemaRegistryClient struct {
+	url      string
+	userName string
+	password string
+	client   *http.Client
+}
+
+func newSchemaRegistryClient(registryUrl string, userName string, password string) *schemaRegistryClient {
+	return &schemaRegistryClient{
+		url:      strings.TrimRight(registryUrl, "/"),
+		userName: userName,
+		password: password,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func subjectName(strategy subjectNameStrategy, topic string, recordFullName string) (string, error) {
+	switch strategy {
+	case topicNameStrategy:
+		return topic + "-value", nil
+	case recordNameStrategy:
+		return recordFullName, nil
+	case topicRecordNameStrategy:
+		return topic + "-" + recordFullName, nil
+	default:
+		return "", errors.Errorf("unknown subject name strategy: %v", strategy)
+	}
+}
+
+// register schema under subject, returns schema id; registering an existing schema returns the existing id
+func (c *schemaRegistryClient) register(subject string, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	registerUrl := fmt.Sprintf("%s/subjects/%s/versions", c.url, url.PathEscape(subject))
+	var id int
+	for i := 0; i < RetryCount; i++ {
+		id, err = c.post(registerUrl, body)
+		if err != nil {
+			log.Warnf("schema registry register subject %s failed, err: %v, start retry...", subject, err.Error())
+			if i+1 == RetryCount {
+				break
+			}
+			time.Sleep(time.Duration(RetryInterval*(i+1)) * time.Second)
+			continue
+		}
+		break
+	}
+	return id, err
+}
+
+func (c *schemaRegistryClient) post(postUrl string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", postUrl, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Content-Type", schemaRegistryContentType)
+	req.Header.Add("Accept", schemaRegistryContentType)
+	if c.userName != "" {
+		req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.userName+":"+c.password)))
+	}
+	response, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("schema registry response status: %d, body: %s", response.StatusCode, string(respBody))
+	}
+	var result struct {
+		Id int `json:"id"`
+	}
+	if err = json.Unmarshal(respBody, &result); err != nil {
+		return 0, err
+	}
+	return result.Id, nil
+}
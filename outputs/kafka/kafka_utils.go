@@ -1,6 +1,7 @@
 package kafka
 
 import (
+	"context"
 	"fmt"
 	gokafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/juju/errors"
@@ -9,25 +10,89 @@ import (
 	"github.com/sqlpub/qin-cdc/config"
 	"github.com/sqlpub/qin-cdc/core"
 	"github.com/sqlpub/qin-cdc/metas"
+	"os"
+	"sort"
 	"strings"
 	"time"
 )
 
 type formatType string
+type partitionStrategy string
+type keyFormatType string
+type decimalHandlingMode string
 
 var inputSequence uint64
 
 const (
-	PluginName                        = "kafka"
-	DefaultBatchSize       int        = 10240
-	DefaultBatchIntervalMs int        = 100
-	RetryCount             int        = 3
-	RetryInterval          int        = 5
-	defaultJson            formatType = "json"
-	aliyunDtsCanal         formatType = "aliyun_dts_canal"
+	PluginName                         = "kafka"
+	DefaultBatchSize        int        = 10240
+	DefaultBatchIntervalMs  int        = 100
+	RetryCount              int        = 3
+	RetryInterval           int        = 5
+	TransactionTimeout                 = 60 * time.Second
+	DefaultCheckpointTopic  string     = "qin_cdc_checkpoint"
+	DefaultSecurityProtocol string     = "plaintext"
+	defaultJson             formatType = "json"
+	aliyunDtsCanal          formatType = "aliyun_dts_canal"
+	debezium                formatType = "debezium"
+	avro                    formatType = "avro"
+
+	DefaultDebeziumServerName string = "qin-cdc"
+
+	decimalPrecise decimalHandlingMode = "precise" // org.apache.kafka.connect.data.Decimal, unscaled bytes
+	decimalString  decimalHandlingMode = "string"
+	decimalDouble  decimalHandlingMode = "double"
+
+	partitionByPrimaryKey  partitionStrategy = "primary-key"
+	partitionByTable       partitionStrategy = "table"
+	partitionByColumn      partitionStrategy = "column"
+	partitionByTransaction partitionStrategy = "transaction"
+
+	hashKey keyFormatType = "hash" // primary key hash number
+	jsonKey keyFormatType = "json" // primary key json
 )
 
 func getProducer(conf *config.KafkaConfig) (producer *gokafka.Producer, err error) {
+	kafkaConf, err := getProducerConfigMap(conf)
+	if err != nil {
+		return nil, err
+	}
+	producer, err = gokafka.NewProducer(kafkaConf)
+	return producer, err
+}
+
+func getTransactionalProducer(conf *config.KafkaConfig) (producer *gokafka.Producer, err error) {
+	kafkaConf, err := getProducerConfigMap(conf)
+	if err != nil {
+		return nil, err
+	}
+	err = kafkaConf.SetKey("transactional.id", conf.Options.TransactionalId)
+	if err != nil {
+		return nil, err
+	}
+	err = kafkaConf.SetKey("enable.idempotence", true)
+	if err != nil {
+		return nil, err
+	}
+	err = kafkaConf.SetKey("acks", "all")
+	if err != nil {
+		return nil, err
+	}
+	producer, err = gokafka.NewProducer(kafkaConf)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TransactionTimeout)
+	defer cancel()
+	err = producer.InitTransactions(ctx)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return producer, nil
+}
+
+func getProducerConfigMap(conf *config.KafkaConfig) (*gokafka.ConfigMap, error) {
 	kafkaConf := &gokafka.ConfigMap{
 		"api.version.request": "true",
 		"message.max.bytes":   1000000,
@@ -35,16 +100,167 @@ func getProducer(conf *config.KafkaConfig) (producer *gokafka.Producer, err erro
 		"retries":             30,
 		"retry.backoff.ms":    1000,
 		"acks":                "1"}
-	err = kafkaConf.SetKey("bootstrap.servers", strings.Join(conf.Brokers, ","))
+	err := setClientConfig(kafkaConf, conf)
 	if err != nil {
 		return nil, err
 	}
-	err = kafkaConf.SetKey("security.protocol", "plaintext")
+	err = setProperties(kafkaConf, conf.Properties)
 	if err != nil {
 		return nil, err
 	}
-	producer, err = gokafka.NewProducer(kafkaConf)
-	return producer, err
+	return kafkaConf, nil
+}
+
+func getConsumer(conf *config.KafkaConfig, groupId string) (consumer *gokafka.Consumer, err error) {
+	kafkaConf := &gokafka.ConfigMap{
+		"api.version.request": "true",
+		"enable.auto.commit":  false,
+		"isolation.level":     "read_committed",
+		"auto.offset.reset":   "earliest"}
+	err = setClientConfig(kafkaConf, conf)
+	if err != nil {
+		return nil, err
+	}
+	err = setProperties(kafkaConf, conf.ConsumerProperties)
+	if err != nil {
+		return nil, err
+	}
+	err = kafkaConf.SetKey("group.id", groupId)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err = gokafka.NewConsumer(kafkaConf)
+	return consumer, err
+}
+
+// setClientConfig brokers and security, shared by producers and consumers
+func setClientConfig(kafkaConf *gokafka.ConfigMap, conf *config.KafkaConfig) (err error) {
+	settings := map[string]string{
+		"bootstrap.servers": strings.Join(conf.Brokers, ","),
+		"security.protocol": DefaultSecurityProtocol,
+	}
+	if conf.SecurityProtocol != "" {
+		settings["security.protocol"] = strings.ToLower(conf.SecurityProtocol)
+	}
+	if conf.Sasl.Mechanism != "" {
+		settings["sasl.mechanism"] = strings.ToUpper(conf.Sasl.Mechanism)
+		settings["sasl.username"] = conf.Sasl.UserName
+		settings["sasl.password"] = conf.Sasl.Password
+	}
+	if conf.Tls.CaFile != "" {
+		settings["ssl.ca.location"] = conf.Tls.CaFile
+	}
+	if conf.Tls.CertFile != "" {
+		settings["ssl.certificate.location"] = conf.Tls.CertFile
+		settings["ssl.key.location"] = conf.Tls.KeyFile
+	}
+	if conf.Tls.KeyPassword != "" {
+		settings["ssl.key.password"] = conf.Tls.KeyPassword
+	}
+	for k, v := range settings {
+		if err = kafkaConf.SetKey(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setProperties user librdkafka properties, producer and consumer have their own
+func setProperties(kafkaConf *gokafka.ConfigMap, properties map[string]interface{}) (err error) {
+	for k, v := range properties {
+		if err = kafkaConf.SetKey(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateConfig check security options and normalize properties values for librdkafka
+func validateConfig(conf *config.KafkaConfig) error {
+	if len(conf.Brokers) == 0 {
+		return errors.Errorf("output %s brokers cannot be empty", PluginName)
+	}
+	securityProtocol := strings.ToLower(conf.SecurityProtocol)
+	switch securityProtocol {
+	case "", "plaintext", "ssl", "sasl_plaintext", "sasl_ssl":
+	default:
+		return errors.Errorf("output %s unknown security-protocol: %s", PluginName, conf.SecurityProtocol)
+	}
+	isSasl := strings.HasPrefix(securityProtocol, "sasl_")
+	switch strings.ToUpper(conf.Sasl.Mechanism) {
+	case "":
+		if isSasl {
+			return errors.Errorf("output %s security-protocol %s requires sasl.mechanism", PluginName, securityProtocol)
+		}
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		if !isSasl {
+			return errors.Errorf("output %s sasl.mechanism requires security-protocol sasl_plaintext or sasl_ssl", PluginName)
+		}
+		if conf.Sasl.UserName == "" {
+			return errors.Errorf("output %s sasl.mechanism %s requires sasl.username", PluginName, conf.Sasl.Mechanism)
+		}
+	default:
+		return errors.Errorf("output %s unknown sasl.mechanism: %s, support PLAIN, SCRAM-SHA-256, SCRAM-SHA-512", PluginName, conf.Sasl.Mechanism)
+	}
+	if (conf.Tls.CertFile == "") != (conf.Tls.KeyFile == "") {
+		return errors.Errorf("output %s tls.cert-file and tls.key-file must be configured together", PluginName)
+	}
+	for _, file := range []string{conf.Tls.CaFile, conf.Tls.CertFile, conf.Tls.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return errors.Errorf("output %s tls file %s err: %v", PluginName, file, err)
+		}
+	}
+	if err := validateProperties(conf.Properties); err != nil {
+		return err
+	}
+	return validateProperties(conf.ConsumerProperties)
+}
+
+func validateProperties(properties map[string]interface{}) error {
+	for k, v := range properties {
+		switch k {
+		case "bootstrap.servers", "transactional.id", "group.id":
+			return errors.Errorf("output %s property %s is managed by qin-cdc, use the dedicated option", PluginName, k)
+		}
+		switch value := v.(type) {
+		case string, bool, int:
+		case int64, float64:
+			properties[k] = fmt.Sprintf("%v", value)
+		default:
+			return errors.Errorf("output %s property %s value type %T is not supported", PluginName, k, v)
+		}
+	}
+	return nil
+}
+
+// resolveTopic topic template, e.g. {schema}.{table}
+func resolveTopic(topicTemplate string, schema string, table string) string {
+	if !isTopicTemplate(topicTemplate) {
+		return topicTemplate
+	}
+	return strings.NewReplacer("{schema}", schema, "{table}", table).Replace(topicTemplate)
+}
+
+func isTopicTemplate(topic string) bool {
+	return strings.Contains(topic, "{schema}") || strings.Contains(topic, "{table}")
+}
+
+func validateRouting(conf *config.KafkaConfig) error {
+	switch partitionStrategy(conf.Options.PartitionBy) {
+	case "", partitionByPrimaryKey, partitionByTable, partitionByColumn, partitionByTransaction:
+	default:
+		return errors.Errorf("output %s unknown partition-by: %s, support %s, %s, %s, %s", PluginName, conf.Options.PartitionBy,
+			partitionByPrimaryKey, partitionByTable, partitionByColumn, partitionByTransaction)
+	}
+	switch keyFormatType(conf.Options.KeyFormat) {
+	case "", hashKey, jsonKey:
+	default:
+		return errors.Errorf("output %s unknown key-format: %s, support %s, %s", PluginName, conf.Options.KeyFormat, hashKey, jsonKey)
+	}
+	return nil
 }
 
 func closeProducer(producer *gokafka.Producer) {
@@ -57,6 +273,16 @@ type formatInterface interface {
 	formatMsg(event *core.Msg, table *metas.Table) interface{}
 }
 
+// keyFormatInterface optional, format generates its own message key
+type keyFormatInterface interface {
+	formatKey(event *core.Msg, table *metas.Table) (interface{}, error)
+}
+
+// encodeFormatInterface optional, format encodes its own binary message value instead of json
+type encodeFormatInterface interface {
+	encodeMsg(event *core.Msg, table *metas.Table, topic string) ([]byte, error)
+}
+
 func (o *OutputPlugin) initFormatPlugin(outputFormat string) {
 	// init kafka format handle func
 	outputFormatType := formatType(fmt.Sprintf("%v", outputFormat))
@@ -65,6 +291,11 @@ func (o *OutputPlugin) initFormatPlugin(outputFormat string) {
 		o.formatInterface = &defaultJsonFormat{}
 	case aliyunDtsCanal:
 		o.formatInterface = &aliyunDtsCanalFormat{}
+	case debezium:
+		o.formatInterface = newDebeziumFormat(o.Options.DebeziumServerName, o.Options.DebeziumSchemasEnable, o.Options.DebeziumDecimalHandlingMode)
+	case avro:
+		o.formatInterface = newAvroFormat(o.Options.SchemaRegistryUrl, o.Options.SchemaRegistryUserName,
+			o.Options.SchemaRegistryPassword, o.Options.SubjectNameStrategy)
 	default:
 		log.Fatalf("Unknown format type: %v", outputFormatType)
 	}
@@ -255,6 +486,49 @@ func (adc *aliyunDtsCanalFormat) formatMsg(event *core.Msg, table *metas.Table)
 	return kMsg
 }
 
+// rowColumns row data columns, table columns first in table order,
+// then columns added or renamed by transforms with type inferred from value
+func rowColumns(row map[string]interface{}, table *metas.Table) []metas.Column {
+	columns := make([]metas.Column, 0, len(row))
+	known := make(map[string]bool, len(table.Columns))
+	for _, column := range table.Columns {
+		if _, ok := row[column.Name]; !ok {
+			continue
+		}
+		known[column.Name] = true
+		columns = append(columns, column)
+	}
+	var others []string
+	for name := range row {
+		if !known[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		column := metas.Column{Name: name}
+		switch row[name].(type) {
+		case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint, bool:
+			column.Type = metas.TypeNumber
+			column.RawType = "bigint"
+		case float32:
+			column.Type = metas.TypeFloat
+			column.RawType = "float"
+		case float64:
+			column.Type = metas.TypeFloat
+			column.RawType = "double"
+		case []byte:
+			column.Type = metas.TypeBinary
+			column.RawType = "blob"
+		default:
+			column.Type = metas.TypeString
+			column.RawType = "varchar"
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
 func DataHash(key interface{}) (string, uint64, error) {
 	hash, err := hashstructure.Hash(key, hashstructure.FormatV2, nil)
 	if err != nil {
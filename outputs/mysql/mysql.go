@@ -2,6 +2,7 @@ package mysql
 
 import (
 	"database/sql"
+	"fmt"
 	"github.com/juju/errors"
 	"github.com/mitchellh/mapstructure"
 	"github.com/siddontang/go-log/log"
@@ -9,6 +10,9 @@ import (
 	"github.com/sqlpub/qin-cdc/core"
 	"github.com/sqlpub/qin-cdc/metas"
 	"github.com/sqlpub/qin-cdc/metrics"
+	"github.com/sqlpub/qin-cdc/utils"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -20,8 +24,16 @@ type OutputPlugin struct {
 		size        int
 		tableMsgMap map[string][]*core.Msg
 	}
+	txnBuffer struct { // transaction apply mode, complete source transactions
+		size int
+		msgs []*core.Msg
+	}
+	txnMsgs      []*core.Msg // transaction apply mode, current source transaction msgs
 	client       *sql.DB
 	lastPosition string
+	name         string
+
+	maxAllowedPacket int // target max_allowed_packet, bulk delete is split by it
 }
 
 func (o *OutputPlugin) Configure(conf map[string]interface{}) error {
@@ -30,6 +42,24 @@ func (o *OutputPlugin) Configure(conf map[string]interface{}) error {
 	if err := mapstructure.Decode(targetConf, o.MysqlConfig); err != nil {
 		return err
 	}
+	switch applyMode(o.Options.ApplyMode) {
+	case "", tableApplyMode, transactionApplyMode:
+	default:
+		return errors.Errorf("output %s unknown apply-mode: %s, support %s, %s", PluginName, o.Options.ApplyMode, tableApplyMode, transactionApplyMode)
+	}
+	if o.Options.ExactlyOnce {
+		// checkpoint must be committed with complete source transactions
+		if applyMode(o.Options.ApplyMode) == tableApplyMode {
+			return errors.Errorf("output %s exactly-once requires apply-mode %s", PluginName, transactionApplyMode)
+		}
+		o.Options.ApplyMode = string(transactionApplyMode)
+		if o.Options.CheckpointTable == "" {
+			o.Options.CheckpointTable = DefaultCheckpointTable
+		}
+		if len(strings.Split(o.Options.CheckpointTable, ".")) != 2 {
+			return errors.Errorf("output %s checkpoint-table %s should be schema.table", PluginName, o.Options.CheckpointTable)
+		}
+	}
 	return nil
 }
 
@@ -43,6 +73,23 @@ func (o *OutputPlugin) NewOutput(metas *core.Metas) {
 	if o.MysqlConfig.Options.BatchIntervalMs == 0 {
 		o.MysqlConfig.Options.BatchIntervalMs = DefaultBatchIntervalMs
 	}
+	if o.MysqlConfig.Options.TableWorkers == 0 {
+		o.MysqlConfig.Options.TableWorkers = DefaultTableWorkers
+	}
+	if o.MysqlConfig.Options.ApplyMode == "" {
+		o.MysqlConfig.Options.ApplyMode = string(tableApplyMode)
+	}
+	for _, router := range metas.Routers.Raws {
+		if router.ConflictPolicy == "" {
+			router.ConflictPolicy = string(overwriteConflictPolicy)
+		}
+		if err := validateConflictPolicy(router); err != nil {
+			log.Fatalf("output %s router %s.%s %v", PluginName, router.SourceSchema, router.SourceTable, err)
+		}
+	}
+	if o.isTransactionApplyMode() && o.MysqlConfig.Options.ParallelWorkers > 1 {
+		log.Warnf("output %s apply-mode %s keeps source order, parallel-workers will not take effect", PluginName, transactionApplyMode)
+	}
 	o.msgTxnBuffer.size = 0
 	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
 
@@ -51,6 +98,7 @@ func (o *OutputPlugin) NewOutput(metas *core.Metas) {
 	if err != nil {
 		log.Fatal("output config client failed. err: ", err.Error())
 	}
+	o.maxAllowedPacket = getMaxAllowedPacket(o.client)
 }
 
 func (o *OutputPlugin) Start(out chan *core.Msg, pos core.Position) {
@@ -65,16 +113,27 @@ func (o *OutputPlugin) Start(out chan *core.Msg, pos core.Position) {
 				switch data.Type {
 				case core.MsgCtl:
 					o.lastPosition = data.InputContext.Pos
+					if o.isTransactionApplyMode() {
+						o.appendTxnBuffer()
+						if o.txnBuffer.size >= o.MysqlConfig.Options.BatchSize {
+							o.flush(pos)
+						}
+					}
 				case core.MsgDML:
+					if o.isTransactionApplyMode() {
+						// applied after the xid or commit ctl msg of its source transaction
+						o.txnMsgs = append(o.txnMsgs, data)
+						continue
+					}
 					o.appendMsgTxnBuffer(data)
 					if o.msgTxnBuffer.size >= o.MysqlConfig.Options.BatchSize {
-						o.flushMsgTxnBuffer(pos)
+						o.flush(pos)
 					}
 				}
 			case <-ticker.C:
-				o.flushMsgTxnBuffer(pos)
+				o.flush(pos)
 			case <-o.Done:
-				o.flushMsgTxnBuffer(pos)
+				o.flush(pos)
 				return
 			}
 
@@ -90,6 +149,18 @@ func (o *OutputPlugin) Close() {
 	log.Infof("output is closed")
 }
 
+func (o *OutputPlugin) isTransactionApplyMode() bool {
+	return applyMode(o.Options.ApplyMode) == transactionApplyMode
+}
+
+func (o *OutputPlugin) flush(pos core.Position) {
+	if o.isTransactionApplyMode() {
+		o.flushTxnBuffer(pos)
+		return
+	}
+	o.flushMsgTxnBuffer(pos)
+}
+
 func (o *OutputPlugin) appendMsgTxnBuffer(msg *core.Msg) {
 	key := metas.GenerateMapRouterKey(msg.Database, msg.Table)
 	o.msgTxnBuffer.tableMsgMap[key] = append(o.msgTxnBuffer.tableMsgMap[key], msg)
@@ -108,15 +179,26 @@ func (o *OutputPlugin) flushMsgTxnBuffer(pos core.Position) {
 	if o.msgTxnBuffer.size == 0 {
 		return
 	}
-	// table level export
-	for k, msgs := range o.msgTxnBuffer.tableMsgMap {
-		columnsMapper := o.metas.Routers.Maps[k].ColumnsMapper
-		targetSchema := o.metas.Routers.Maps[k].TargetSchema
-		targetTable := o.metas.Routers.Maps[k].TargetTable
-		err := o.execute(msgs, columnsMapper, targetSchema, targetTable)
+	if o.Options.ParallelWorkers > 1 {
+		err := o.executeParallel(o.msgTxnBuffer.tableMsgMap)
 		if err != nil {
-			log.Fatalf("do %s bulk err %v", PluginName, err)
+			// position is not advanced, resume from the last flushed position
+			log.Fatalf("do %s parallel bulk err %v", PluginName, err)
 		}
+		o.clearMsgTxnBuffer()
+		return
+	}
+	// table level export, tables flushed concurrently, msgs of a table in order
+	tasks := make([]func() error, 0, len(o.msgTxnBuffer.tableMsgMap))
+	for k, msgs := range o.msgTxnBuffer.tableMsgMap {
+		router := o.metas.Routers.Maps[k]
+		tasks = append(tasks, func() error {
+			return o.execute(msgs, router)
+		})
+	}
+	if err := utils.RunTasks(o.Options.TableWorkers, tasks); err != nil {
+		// position is not advanced, resume from the last flushed position
+		log.Fatalf("do %s bulk err %v", PluginName, err)
 	}
 	o.clearMsgTxnBuffer()
 }
@@ -126,47 +208,200 @@ func (o *OutputPlugin) clearMsgTxnBuffer() {
 	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
 }
 
-func (o *OutputPlugin) execute(msgs []*core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) error {
-	if len(columnsMapper.PrimaryKeys) == 0 {
-		return errors.Errorf("only support data has primary key")
+// appendTxnBuffer source transaction completed, move its msgs to txn buffer
+func (o *OutputPlugin) appendTxnBuffer() {
+	o.txnBuffer.msgs = append(o.txnBuffer.msgs, o.txnMsgs...)
+	o.txnBuffer.size += len(o.txnMsgs)
+	o.txnMsgs = make([]*core.Msg, 0)
+}
+
+// flushTxnBuffer apply buffered source transactions in source order inside one target transaction
+func (o *OutputPlugin) flushTxnBuffer(pos core.Position) {
+	defer func() {
+		// flush position
+		err := pos.Update(o.lastPosition)
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+	}()
+
+	if o.txnBuffer.size == 0 {
+		return
+	}
+	stmts := make([]*sqlStmt, 0)
+	for _, tableMsgs := range o.splitTableMsgs(o.txnBuffer.msgs) {
+		router := o.metas.Routers.Maps[metas.GenerateMapRouterKey(tableMsgs[0].Database, tableMsgs[0].Table)]
+		tableStmts, err := o.generateStmts(tableMsgs, router)
+		if err != nil {
+			log.Fatalf("do %s transaction err %v", PluginName, err)
+		}
+		stmts = append(stmts, tableStmts...)
+	}
+	if o.Options.ExactlyOnce {
+		stmts = append(stmts, o.generateCheckpointStmt())
+	}
+	err := o.executeTxn(stmts)
+	if err != nil {
+		log.Fatalf("do %s transaction err %v", PluginName, err)
+	}
+	o.clearTxnBuffer()
+}
+
+func (o *OutputPlugin) clearTxnBuffer() {
+	o.txnBuffer.size = 0
+	o.txnBuffer.msgs = make([]*core.Msg, 0)
+}
+
+// splitTableMsgs split msgs into consecutive runs of the same table, keep source order
+func (o *OutputPlugin) splitTableMsgs(msgs []*core.Msg) [][]*core.Msg {
+	msgsList := make([][]*core.Msg, 0)
+	for i, msg := range msgs {
+		if i == 0 || msg.Database != msgs[i-1].Database || msg.Table != msgs[i-1].Table {
+			msgsList = append(msgsList, make([]*core.Msg, 0))
+		}
+		msgsList[len(msgsList)-1] = append(msgsList[len(msgsList)-1], msg)
+	}
+	return msgsList
+}
+
+func (o *OutputPlugin) execute(msgs []*core.Msg, router *metas.Router) error {
+	stmts, err := o.generateStmts(msgs, router)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		err = o.executeSQL(stmt)
+		if err != nil {
+			return err
+		}
+		log.Debugf("output %s sql: %v; args: %v", PluginName, stmt.sql, stmt.args)
+		// log.Debugf("%s bulk sync %s.%s row data num: %d", PluginName, targetSchema, targetTable, len(msgs))
+
+		// prom write event number counter
+		metrics.OpsWriteProcessed.Add(float64(stmt.rows))
+	}
+	return nil
+}
+
+// generateStmts table msgs to sql statements, keep msgs order
+func (o *OutputPlugin) generateStmts(msgs []*core.Msg, router *metas.Router) ([]*sqlStmt, error) {
+	var stmts []*sqlStmt
+	var err error
+	if len(router.ColumnsMapper.RowKeys) == 0 {
+		stmts, err = o.generateKeylessStmts(msgs, router)
+	} else {
+		stmts, err = o.generateKeyStmts(msgs, router)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range stmts {
+		stmt.table = fmt.Sprintf("%s.%s", router.TargetSchema, router.TargetTable)
+		stmt.policy = conflictPolicy(router.ConflictPolicy)
 	}
+	return stmts, nil
+}
 
+func (o *OutputPlugin) generateKeyStmts(msgs []*core.Msg, router *metas.Router) ([]*sqlStmt, error) {
+	columnsMapper := router.ColumnsMapper
+	// primary key changed update, upsert would leave the old row behind
+	msgs = core.SplitPrimaryKeyChange(msgs, columnsMapper.RowKeys)
+	if o.Options.Compact && len(columnsMapper.UniqueKeys) == 0 {
+		// merge changes of a primary key to its final state, other unique keys of the table need the
+		// source order of rows across keys, e.g. a value freed by one row and taken by another
+		var compactedMsgs []*core.Msg
+		if conflictPolicy(router.ConflictPolicy) == ignoreConflictPolicy {
+			// insert ignore of a merged insert and update would drop the update if the row exists
+			compactedMsgs = core.CompactUpsertMsgs(msgs, columnsMapper.RowKeys)
+		} else {
+			compactedMsgs = core.CompactMsgs(msgs, columnsMapper.RowKeys)
+		}
+		metrics.OpsWriteCompacted.Add(float64(len(msgs) - len(compactedMsgs)))
+		msgs = compactedMsgs
+	}
+	stmts := make([]*sqlStmt, 0)
 	splitMsgsList := o.splitMsgs(msgs)
 	for _, splitMsgs := range splitMsgsList {
 		if splitMsgs[0].DmlMsg.Action != core.DeleteAction {
 			// insert and update can bulk exec
-			bulkSQL, args, err := o.generateBulkInsertOnDuplicateKeyUpdateSQL(splitMsgs, columnsMapper, targetSchema, targetTable)
-			err = o.executeSQL(bulkSQL, args)
+			upsertStmts, err := o.generateUpsertStmts(splitMsgs, router)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			log.Debugf("output %s sql: %v; args: %v", PluginName, bulkSQL, args)
+			stmts = append(stmts, upsertStmts...)
 		} else {
-			if len(columnsMapper.PrimaryKeys) > 1 { // multi-pk single sql exec (delete from table where pk1 = ? and pk2 = ? ...)
-				for _, msg := range splitMsgs {
-					singleSQL, args, err := o.generateSingleDeleteSQL(msg, columnsMapper, targetSchema, targetTable)
-					err = o.executeSQL(singleSQL, args)
-					if err != nil {
-						return err
-					}
-					log.Debugf("output %s sql: %v; args: %v", PluginName, singleSQL, args)
-				}
-
-			} else { // one-pk bulk sql exec (delete from table where pk in (?,? ..))
-				bulkSQL, args, err := o.generateBulkDeleteSQL(splitMsgs, columnsMapper, targetSchema, targetTable)
-				err = o.executeSQL(bulkSQL, args)
-				if err != nil {
-					return err
-				}
-				log.Debugf("output %s sql: %v; args: %v", PluginName, bulkSQL, args)
+			deleteStmts, err := o.generateDeleteStmts(splitMsgs, router)
+			if err != nil {
+				return nil, err
 			}
+			stmts = append(stmts, deleteStmts...)
 		}
-		// log.Debugf("%s bulk sync %s.%s row data num: %d", PluginName, targetSchema, targetTable, len(msgs))
+	}
+	return stmts, nil
+}
 
-		// prom write event number counter
-		metrics.OpsWriteProcessed.Add(float64(len(splitMsgs)))
+// generateDeleteStmts bulk delete by key, split by max_allowed_packet,
+// rows not deleted are conflicts except under overwrite, where a missing row is already the wanted state
+func (o *OutputPlugin) generateDeleteStmts(msgs []*core.Msg, router *metas.Router) ([]*sqlStmt, error) {
+	columns := router.ColumnsMapper.RowKeys
+	newerWins := conflictPolicy(router.ConflictPolicy) == newerWinsConflictPolicy
+	checkAffected := conflictPolicy(router.ConflictPolicy) != overwriteConflictPolicy
+	if newerWins {
+		columns = append(slices.Clone(columns), router.ConflictColumn)
 	}
-	return nil
+	stmts := make([]*sqlStmt, 0)
+	for _, packetMsgs := range o.splitMsgsByPacket(msgs, columns) {
+		var bulkSQL string
+		var args []interface{}
+		var err error
+		if newerWins {
+			bulkSQL, args, err = o.generateNewerWinsDeleteSQL(packetMsgs, router)
+		} else {
+			bulkSQL, args, err = o.generateBulkDeleteSQL(packetMsgs, router.ColumnsMapper, router.TargetSchema, router.TargetTable)
+		}
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, &sqlStmt{sql: bulkSQL, args: args, rows: len(packetMsgs), checkAffected: checkAffected})
+	}
+	return stmts, nil
+}
+
+// generateKeylessStmts table without primary key or unique key, inserts are bulk exec,
+// update and delete exec one by one and change at most one row matched by full row image
+func (o *OutputPlugin) generateKeylessStmts(msgs []*core.Msg, router *metas.Router) ([]*sqlStmt, error) {
+	columnsMapper, targetSchema, targetTable := router.ColumnsMapper, router.TargetSchema, router.TargetTable
+	// without key inserts never conflict, update or delete matching no row is a conflict except under overwrite
+	checkAffected := conflictPolicy(router.ConflictPolicy) != overwriteConflictPolicy
+	stmts := make([]*sqlStmt, 0)
+	insertMsgs := make([]*core.Msg, 0)
+	for i, msg := range msgs {
+		var singleSQL string
+		var args []interface{}
+		var err error
+		rows := 1
+		switch msg.DmlMsg.Action {
+		case core.InsertAction:
+			insertMsgs = append(insertMsgs, msg)
+			if i < len(msgs)-1 && msgs[i+1].DmlMsg.Action == core.InsertAction {
+				continue
+			}
+			singleSQL, args, err = o.generateBulkInsertSQL(insertMsgs, columnsMapper, targetSchema, targetTable, false)
+			rows = len(insertMsgs)
+			insertMsgs = make([]*core.Msg, 0)
+		case core.UpdateAction:
+			singleSQL, args, err = o.generateKeylessUpdateSQL(msg, columnsMapper, targetSchema, targetTable)
+		case core.DeleteAction:
+			singleSQL, args, err = o.generateKeylessDeleteSQL(msg, columnsMapper, targetSchema, targetTable)
+		default:
+			log.Fatalf("unhandled message type: %v", msg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, &sqlStmt{sql: singleSQL, args: args, rows: rows, checkAffected: checkAffected && msg.DmlMsg.Action != core.InsertAction})
+	}
+	return stmts, nil
 }
 
 func (o *OutputPlugin) splitMsgs(msgs []*core.Msg) [][]*core.Msg {
@@ -201,12 +436,15 @@ func (o *OutputPlugin) splitMsgs(msgs []*core.Msg) [][]*core.Msg {
 	return msgsList
 }
 
-func (o *OutputPlugin) executeSQL(sqlCmd string, args []interface{}) error {
+func (o *OutputPlugin) executeSQL(stmt *sqlStmt) error {
 	var err error
-	var result sql.Result
+	var conflicts int
 	for i := 0; i < RetryCount; i++ {
-		result, err = o.client.Exec(sqlCmd, args...)
+		conflicts, err = o.execStmt(o.client, stmt)
 		if err != nil {
+			if isConflictError(err) {
+				break
+			}
 			log.Warnf("exec data failed, err: %v, execute retry...", err.Error())
 			if i+1 == RetryCount {
 				break
@@ -216,11 +454,54 @@ func (o *OutputPlugin) executeSQL(sqlCmd string, args []interface{}) error {
 		}
 		break
 	}
+	addConflictMetrics(conflicts)
+	return err
+}
+
+// executeTxn execute statements in one target transaction, retry the whole transaction on failure
+func (o *OutputPlugin) executeTxn(stmts []*sqlStmt) error {
+	var err error
+	var conflicts int
+	for i := 0; i < RetryCount; i++ {
+		conflicts, err = o.executeTxnOnce(stmts)
+		if err != nil {
+			if isConflictError(err) {
+				break
+			}
+			log.Warnf("exec transaction failed, err: %v, execute retry...", err.Error())
+			if i+1 == RetryCount {
+				break
+			}
+			time.Sleep(time.Duration(RetryInterval*(i+1)) * time.Second)
+			continue
+		}
+		break
+	}
+	addConflictMetrics(conflicts)
 	if err != nil {
 		return err
 	}
-	if result == nil {
-		return errors.Errorf("execute bulksql retry failed, result is nil")
+	for _, stmt := range stmts {
+		// prom write event number counter
+		metrics.OpsWriteProcessed.Add(float64(stmt.rows))
 	}
-	return err
+	return nil
+}
+
+func (o *OutputPlugin) executeTxnOnce(stmts []*sqlStmt) (int, error) {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return 0, err
+	}
+	conflicts := 0
+	for _, stmt := range stmts {
+		stmtConflicts, err := o.execStmt(tx, stmt)
+		conflicts += stmtConflicts
+		if err != nil {
+			_ = tx.Rollback()
+			return conflicts, err
+		}
+		log.Debugf("output %s sql: %v; args: %v", PluginName, stmt.sql, stmt.args)
+	}
+	return conflicts, tx.Commit()
 }
@@ -0,0 +1,49 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// LoadCheckpoint exactly once, create checkpoint table if not exists and get position of this pipeline
+func (o *OutputPlugin) LoadCheckpoint(name string) (string, error) {
+	o.name = name
+	if !o.Options.ExactlyOnce {
+		return "", nil
+	}
+	schema, table := o.checkpointTable()
+	_, err := o.client.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", schema))
+	if err != nil {
+		return "", err
+	}
+	_, err = o.client.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s` ("+
+		"`name` varchar(255) NOT NULL, "+
+		"`position` text NOT NULL, "+
+		"`updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, "+
+		"PRIMARY KEY (`name`))", schema, table))
+	if err != nil {
+		return "", err
+	}
+	var pos string
+	err = o.client.QueryRow(fmt.Sprintf("SELECT `position` FROM `%s`.`%s` WHERE `name` = ?", schema, table), name).Scan(&pos)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return pos, err
+}
+
+// generateCheckpointStmt position upsert, executed in the same target transaction as data
+func (o *OutputPlugin) generateCheckpointStmt() *sqlStmt {
+	schema, table := o.checkpointTable()
+	return &sqlStmt{
+		sql: fmt.Sprintf("INSERT INTO `%s`.`%s` (`name`, `position`) VALUES (?, ?) "+
+			"ON DUPLICATE KEY UPDATE `position` = VALUES(`position`)", schema, table),
+		args: []interface{}{o.name, o.lastPosition},
+	}
+}
+
+func (o *OutputPlugin) checkpointTable() (schema string, table string) {
+	splits := strings.Split(o.Options.CheckpointTable, ".")
+	return splits[0], splits[1]
+}
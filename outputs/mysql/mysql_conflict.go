@@ -0,0 +1,271 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"github.com/sqlpub/qin-cdc/metrics"
+	"slices"
+	"strings"
+)
+
+type conflictPolicy string
+
+const (
+	overwriteConflictPolicy conflictPolicy = "overwrite"  // upsert, source row always wins
+	ignoreConflictPolicy    conflictPolicy = "ignore"     // insert ignore, existing target row wins
+	failConflictPolicy      conflictPolicy = "fail"       // duplicate key or missing row stops the output
+	newerWinsConflictPolicy conflictPolicy = "newer-wins" // row with greater or equal conflict-column wins
+
+	mysqlErrDupEntry uint16 = 1062
+)
+
+// conflictError stops retry, replaying the same statement conflicts again
+type conflictError struct {
+	table     string
+	conflicts int
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("conflict-policy %s, %s has %d conflicts", failConflictPolicy, e.table, e.conflicts)
+}
+
+func isConflictError(err error) bool {
+	var conflictErr *conflictError
+	return errors.As(err, &conflictErr)
+}
+
+// sqlExecer *sql.DB or *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func validateConflictPolicy(router *metas.Router) error {
+	switch conflictPolicy(router.ConflictPolicy) {
+	case overwriteConflictPolicy, ignoreConflictPolicy, failConflictPolicy:
+	case newerWinsConflictPolicy:
+		if router.ConflictColumn == "" {
+			return errors.Errorf("conflict-policy %s requires router conflict-column", newerWinsConflictPolicy)
+		}
+		if len(router.ColumnsMapper.RowKeys) == 0 {
+			return errors.Errorf("conflict-policy %s requires a primary key, not null unique key or key-columns", newerWinsConflictPolicy)
+		}
+		if _, ok := router.ColumnsMapper.MapMapper[router.ConflictColumn]; !ok {
+			return errors.Errorf("conflict-column %s not found in mapped columns", router.ConflictColumn)
+		}
+		if slices.Contains(router.ColumnsMapper.RowKeys, router.ConflictColumn) {
+			return errors.Errorf("conflict-column %s can not be a key column", router.ConflictColumn)
+		}
+	default:
+		return errors.Errorf("unknown conflict-policy: %s, support %s, %s, %s, %s", router.ConflictPolicy,
+			overwriteConflictPolicy, ignoreConflictPolicy, failConflictPolicy, newerWinsConflictPolicy)
+	}
+	return nil
+}
+
+// generateUpsertStmts insert and update msgs of a keyed table by router conflict policy, keep msgs order
+func (o *OutputPlugin) generateUpsertStmts(msgs []*core.Msg, router *metas.Router) ([]*sqlStmt, error) {
+	columnsMapper, targetSchema, targetTable := router.ColumnsMapper, router.TargetSchema, router.TargetTable
+	switch conflictPolicy(router.ConflictPolicy) {
+	case newerWinsConflictPolicy:
+		stmt, err := o.generateNewerWinsUpsertStmt(msgs, router)
+		if err != nil {
+			return nil, err
+		}
+		return []*sqlStmt{stmt}, nil
+	case ignoreConflictPolicy, failConflictPolicy:
+	default:
+		bulkSQL, args, err := o.generateBulkInsertOnDuplicateKeyUpdateSQL(msgs, columnsMapper, targetSchema, targetTable)
+		if err != nil {
+			return nil, err
+		}
+		return []*sqlStmt{{sql: bulkSQL, args: args, rows: len(msgs)}}, nil
+	}
+
+	// ignore and fail policy, inserts conflict on duplicate key, updates conflict on missing row
+	stmts := make([]*sqlStmt, 0)
+	for _, actionMsgs := range splitInsertMsgs(msgs) {
+		if actionMsgs[0].DmlMsg.Action == core.InsertAction {
+			ignore := conflictPolicy(router.ConflictPolicy) == ignoreConflictPolicy
+			bulkSQL, args, err := o.generateBulkInsertSQL(actionMsgs, columnsMapper, targetSchema, targetTable, ignore)
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, &sqlStmt{sql: bulkSQL, args: args, rows: len(actionMsgs), checkAffected: ignore})
+			continue
+		}
+		if conflictPolicy(router.ConflictPolicy) == ignoreConflictPolicy {
+			// missing row is inserted
+			bulkSQL, args, err := o.generateBulkInsertOnDuplicateKeyUpdateSQL(actionMsgs, columnsMapper, targetSchema, targetTable)
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, &sqlStmt{sql: bulkSQL, args: args, rows: len(actionMsgs)})
+			continue
+		}
+		for _, msg := range actionMsgs {
+			singleSQL, args, err := o.generateSingleUpdateSQL(msg, columnsMapper, targetSchema, targetTable)
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, &sqlStmt{sql: singleSQL, args: args, rows: 1, checkAffected: true})
+		}
+	}
+	return stmts, nil
+}
+
+// splitInsertMsgs split msgs into consecutive runs of insert and of other actions
+func splitInsertMsgs(msgs []*core.Msg) [][]*core.Msg {
+	msgsList := make([][]*core.Msg, 0)
+	for i, msg := range msgs {
+		if i == 0 || (msg.DmlMsg.Action == core.InsertAction) != (msgs[i-1].DmlMsg.Action == core.InsertAction) {
+			msgsList = append(msgsList, make([]*core.Msg, 0))
+		}
+		msgsList[len(msgsList)-1] = append(msgsList[len(msgsList)-1], msg)
+	}
+	return msgsList
+}
+
+// generateSingleUpdateSQL update row by key, row not found is a conflict
+func (o *OutputPlugin) generateSingleUpdateSQL(msg *core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) (string, []interface{}, error) {
+	setSql := make([]string, 0, len(columnsMapper.MapMapperOrder))
+	args := make([]interface{}, 0, len(columnsMapper.MapMapperOrder)+len(columnsMapper.RowKeys))
+	for _, sourceColumn := range columnsMapper.MapMapperOrder {
+		setSql = append(setSql, fmt.Sprintf("`%s` = ?", columnsMapper.MapMapper[sourceColumn]))
+		args = append(args, msg.DmlMsg.Data[sourceColumn])
+	}
+	whereSql := make([]string, 0, len(columnsMapper.RowKeys))
+	for _, pk := range columnsMapper.RowKeys {
+		whereSql = append(whereSql, fmt.Sprintf("`%s` = ?", columnsMapper.MapMapper[pk]))
+		args = append(args, msg.DmlMsg.Data[pk])
+	}
+	stmt := fmt.Sprintf("UPDATE `%s`.`%s` SET %s WHERE %s", targetSchema, targetTable, strings.Join(setSql, ","), strings.Join(whereSql, " AND "))
+	return stmt, args, nil
+}
+
+// generateNewerWinsUpsertStmt upsert keeps existing row if its conflict-column is greater,
+// stale rows are counted by a query before exec
+func (o *OutputPlugin) generateNewerWinsUpsertStmt(msgs []*core.Msg, router *metas.Router) (*sqlStmt, error) {
+	columnsMapper := router.ColumnsMapper
+	insertSQL, args, err := o.generateBulkInsertSQL(msgs, columnsMapper, router.TargetSchema, router.TargetTable, false)
+	if err != nil {
+		return nil, err
+	}
+	versionColumn := columnsMapper.MapMapper[router.ConflictColumn]
+	newer := fmt.Sprintf("(`%s` IS NULL OR VALUES(`%s`) >= `%s`)", versionColumn, versionColumn, versionColumn)
+	assignSql := make([]string, 0, len(columnsMapper.MapMapperOrder))
+	for _, sourceColumn := range columnsMapper.MapMapperOrder {
+		if sourceColumn == router.ConflictColumn || slices.Contains(columnsMapper.RowKeys, sourceColumn) {
+			continue
+		}
+		targetColumn := columnsMapper.MapMapper[sourceColumn]
+		assignSql = append(assignSql, fmt.Sprintf("`%s` = IF(%s, VALUES(`%s`), `%s`)", targetColumn, newer, targetColumn, targetColumn))
+	}
+	// conflict-column assigned last, assignments before it compare with the existing value
+	assignSql = append(assignSql, fmt.Sprintf("`%s` = IF(%s, VALUES(`%s`), `%s`)", versionColumn, newer, versionColumn, versionColumn))
+
+	// stale rows: target row exists with greater conflict-column
+	selectSql := make([]string, 0, len(msgs))
+	conflictArgs := make([]interface{}, 0, len(msgs)*(len(columnsMapper.RowKeys)+1))
+	for i, msg := range msgs {
+		placeHolders := make([]string, 0, len(columnsMapper.RowKeys)+1)
+		for j, pk := range columnsMapper.RowKeys {
+			if i == 0 {
+				placeHolders = append(placeHolders, fmt.Sprintf("? AS `k%d`", j))
+			} else {
+				placeHolders = append(placeHolders, "?")
+			}
+			conflictArgs = append(conflictArgs, msg.DmlMsg.Data[pk])
+		}
+		if i == 0 {
+			placeHolders = append(placeHolders, "? AS `v`")
+		} else {
+			placeHolders = append(placeHolders, "?")
+		}
+		conflictArgs = append(conflictArgs, msg.DmlMsg.Data[router.ConflictColumn])
+		selectSql = append(selectSql, "SELECT "+strings.Join(placeHolders, ","))
+	}
+	joinSql := make([]string, 0, len(columnsMapper.RowKeys))
+	for j, pk := range columnsMapper.RowKeys {
+		joinSql = append(joinSql, fmt.Sprintf("t.`%s` = s.`k%d`", columnsMapper.MapMapper[pk], j))
+	}
+	conflictSql := fmt.Sprintf("SELECT COUNT(*) FROM `%s`.`%s` AS t JOIN (%s) AS s ON %s WHERE t.`%s` > s.`v`",
+		router.TargetSchema, router.TargetTable, strings.Join(selectSql, " UNION ALL "), strings.Join(joinSql, " AND "), versionColumn)
+
+	return &sqlStmt{
+		sql:          fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", insertSQL, strings.Join(assignSql, ",")),
+		args:         args,
+		rows:         len(msgs),
+		conflictSql:  conflictSql,
+		conflictArgs: conflictArgs,
+	}, nil
+}
+
+// generateNewerWinsDeleteSQL delete row only if its conflict-column is not greater, rows not deleted are conflicts
+func (o *OutputPlugin) generateNewerWinsDeleteSQL(msgs []*core.Msg, router *metas.Router) (string, []interface{}, error) {
+	columnsMapper := router.ColumnsMapper
+	versionColumn := columnsMapper.MapMapper[router.ConflictColumn]
+	rowSql := make([]string, 0, len(msgs))
+	args := make([]interface{}, 0, len(msgs)*(len(columnsMapper.RowKeys)+1))
+	for _, msg := range msgs {
+		whereSql := make([]string, 0, len(columnsMapper.RowKeys)+1)
+		for _, pk := range columnsMapper.RowKeys {
+			whereSql = append(whereSql, fmt.Sprintf("`%s` = ?", columnsMapper.MapMapper[pk]))
+			args = append(args, msg.DmlMsg.Data[pk])
+		}
+		whereSql = append(whereSql, fmt.Sprintf("(`%s` IS NULL OR `%s` <= ?)", versionColumn, versionColumn))
+		args = append(args, msg.DmlMsg.Data[router.ConflictColumn])
+		rowSql = append(rowSql, "("+strings.Join(whereSql, " AND ")+")")
+	}
+	if len(rowSql) == 0 {
+		return "", nil, errors.Errorf("where sql is empty, probably missing pk")
+	}
+	stmt := fmt.Sprintf("DELETE FROM `%s`.`%s` WHERE %s", router.TargetSchema, router.TargetTable, strings.Join(rowSql, " OR "))
+	return stmt, args, nil
+}
+
+// execStmt exec statement and detect conflicts, fail policy conflicts return conflictError
+func (o *OutputPlugin) execStmt(db sqlExecer, stmt *sqlStmt) (conflicts int, err error) {
+	if stmt.conflictSql != "" {
+		if err = db.QueryRow(stmt.conflictSql, stmt.conflictArgs...).Scan(&conflicts); err != nil {
+			return 0, err
+		}
+	}
+	result, err := db.Exec(stmt.sql, stmt.args...)
+	if err != nil {
+		var mysqlErr *gomysql.MySQLError
+		if stmt.policy == failConflictPolicy && errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDupEntry {
+			log.Warnf("output %s conflict-policy %s, %s duplicate key, err: %v", PluginName, stmt.policy, stmt.table, err)
+			return 1, &conflictError{table: stmt.table, conflicts: 1}
+		}
+		return 0, err
+	}
+	if stmt.checkAffected {
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if int64(stmt.rows) > affected {
+			conflicts += stmt.rows - int(affected)
+		}
+	}
+	if conflicts > 0 {
+		log.Warnf("output %s conflict-policy %s, %s detected %d conflicts in %d rows", PluginName, stmt.policy, stmt.table, conflicts, stmt.rows)
+		if stmt.policy == failConflictPolicy {
+			return conflicts, &conflictError{table: stmt.table, conflicts: conflicts}
+		}
+	}
+	return conflicts, nil
+}
+
+func addConflictMetrics(conflicts int) {
+	if conflicts > 0 {
+		// prom write conflict number counter
+		metrics.OpsWriteConflicts.Add(float64(conflicts))
+	}
+}
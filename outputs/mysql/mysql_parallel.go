@@ -0,0 +1,151 @@
+package mysql
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"github.com/sqlpub/qin-cdc/utils"
+	"hash/fnv"
+)
+
+// keyGroups union-find of row keys, rows whose keys are linked (e.g. primary key changed by update,
+// equal values of another unique key) belong to one group and are applied by the same worker in source order
+type keyGroups struct {
+	parent map[string]string
+}
+
+func newKeyGroups() *keyGroups {
+	return &keyGroups{parent: make(map[string]string)}
+}
+
+func (g *keyGroups) find(key string) string {
+	root, ok := g.parent[key]
+	if !ok {
+		g.parent[key] = key
+		return key
+	}
+	if root == key {
+		return key
+	}
+	root = g.find(root)
+	g.parent[key] = root
+	return root
+}
+
+func (g *keyGroups) union(key1 string, key2 string) {
+	root1, root2 := g.find(key1), g.find(key2)
+	if root1 != root2 {
+		g.parent[root2] = root1
+	}
+}
+
+// executeParallel dispatch rows to workers by hash of table and primary key,
+// per key order is kept, returns after all workers finished
+func (o *OutputPlugin) executeParallel(tableMsgMap map[string][]*core.Msg) error {
+	workerTableMsgs, err := o.dispatchParallel(tableMsgMap)
+	if err != nil {
+		return err
+	}
+	tasks := make([]func() error, 0, len(workerTableMsgs))
+	for _, tableMsgs := range workerTableMsgs {
+		if len(tableMsgs) == 0 {
+			continue
+		}
+		tasks = append(tasks, func() error {
+			for k, msgs := range tableMsgs {
+				if err := o.execute(msgs, o.metas.Routers.Maps[k]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	// errors of all workers
+	return utils.RunTasks(len(workerTableMsgs), tasks)
+}
+
+// dispatchParallel worker -> table -> msgs in source order, rows of a key group go to the same worker
+func (o *OutputPlugin) dispatchParallel(tableMsgMap map[string][]*core.Msg) ([]map[string][]*core.Msg, error) {
+	type keyedMsg struct {
+		key string
+		msg *core.Msg
+	}
+	groups := newKeyGroups()
+	tableKeyedMsgs := make(map[string][]keyedMsg, len(tableMsgMap))
+	for k, msgs := range tableMsgMap {
+		// table without key has one row key, all rows are applied by the same worker in source order
+		columnsMapper := o.metas.Routers.Maps[k].ColumnsMapper
+		keyedMsgs := make([]keyedMsg, 0, len(msgs))
+		for _, msg := range msgs {
+			key, err := rowKey(k, columnsMapper.RowKeys, msg.DmlMsg.Data)
+			if err != nil {
+				return nil, err
+			}
+			groups.find(key)
+			if msg.DmlMsg.Action == core.UpdateAction && msg.DmlMsg.Old != nil {
+				// cross-row dependency, old key and new key must be applied in order
+				oldKey, err := rowKey(k, columnsMapper.RowKeys, msg.DmlMsg.Old)
+				if err != nil {
+					return nil, err
+				}
+				groups.union(key, oldKey)
+			}
+			// rows with equal values of another unique key conflict, applied in order
+			for i, uniqueKey := range columnsMapper.UniqueKeys {
+				for _, row := range []map[string]interface{}{msg.DmlMsg.Data, msg.DmlMsg.Old} {
+					ukKey, ok, err := uniqueKeyValue(k, i, uniqueKey, row)
+					if err != nil {
+						return nil, err
+					}
+					if ok {
+						groups.union(key, ukKey)
+					}
+				}
+			}
+			keyedMsgs = append(keyedMsgs, keyedMsg{key: key, msg: msg})
+		}
+		tableKeyedMsgs[k] = keyedMsgs
+	}
+
+	workers := o.Options.ParallelWorkers
+	workerTableMsgs := make([]map[string][]*core.Msg, workers)
+	for i := range workerTableMsgs {
+		workerTableMsgs[i] = make(map[string][]*core.Msg)
+	}
+	for k, keyedMsgs := range tableKeyedMsgs {
+		for _, km := range keyedMsgs {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(groups.find(km.key)))
+			worker := int(h.Sum32() % uint32(workers))
+			workerTableMsgs[worker][k] = append(workerTableMsgs[worker][k], km.msg)
+		}
+	}
+	return workerTableMsgs, nil
+}
+
+func rowKey(tableKey string, primaryKeys []string, data map[string]interface{}) (string, error) {
+	values := make([]interface{}, 0, len(primaryKeys))
+	for _, pk := range primaryKeys {
+		values = append(values, data[pk])
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return tableKey + metas.MapRouterKeyDelimiter + string(b), nil
+}
+
+// uniqueKeyValue key of unique key i values of row, not ok if row is nil or a value is null, nulls do not conflict
+func uniqueKeyValue(tableKey string, i int, uniqueKey []string, row map[string]interface{}) (string, bool, error) {
+	if row == nil {
+		return "", false, nil
+	}
+	for _, column := range uniqueKey {
+		if row[column] == nil {
+			return "", false, nil
+		}
+	}
+	key, err := rowKey(fmt.Sprintf("%s%suk%d", tableKey, metas.MapRouterKeyDelimiter, i), uniqueKey, row)
+	return key, err == nil, err
+}
@@ -0,0 +1,372 @@
+package mysql
+
+import (
+	"fmt"
+	"github.com/sqlpub/qin-cdc/config"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"github.com/sqlpub/qin-cdc/transforms"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestKeylessAddMetaColumns rows of a keyless table are matched by the row image without metadata columns,
+// the stored _op and _ts are of the insert, not of the update or delete
+func TestKeylessAddMetaColumns(t *testing.T) {
+	router := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t"}
+	router.ColumnsMapper.SourceColumns = []string{"id", "v"}
+	router.ColumnsMapper.TargetColumns = []string{"id", "v", "src", "_op", "_ts"}
+	routers := &metas.Routers{Raws: []*metas.Router{router}}
+	trans := transforms.NewMatcherTransforms([]config.TransformConfig{{Type: transforms.AddColumnTransName, Config: map[string]interface{}{
+		"match-schema": "db", "match-table": "t",
+		"columns": []interface{}{"src", "_op", "_ts"}, "values": []interface{}{"'mysql'", "_op", "_ts"},
+	}}}, routers)
+	(&core.Metas{Routers: routers}).InitRouterColumnsMapperMapMapper()
+
+	o := &OutputPlugin{}
+	update := &core.Msg{Database: "db", Table: "t", Type: core.MsgDML, DmlMsg: &core.DMLMsg{Action: core.UpdateAction,
+		Data: map[string]interface{}{"id": 1, "v": "b"}, Old: map[string]interface{}{"id": 1, "v": "a"}}}
+	trans.IterateTransforms(update)
+	stmt, args, err := o.generateKeylessUpdateSQL(update, router.ColumnsMapper, "db", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStmt := "UPDATE `db`.`t` SET `id` = ?,`v` = ?,`src` = ?,`_op` = ?,`_ts` = ? WHERE `id` <=> ? AND `v` <=> ? AND `src` <=> ? LIMIT 1"
+	wantArgs := []interface{}{1, "b", "mysql", "update", update.DmlMsg.Data["_ts"], 1, "a", "mysql"}
+	if stmt != wantStmt || !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("update = %s %v", stmt, args)
+	}
+
+	del := &core.Msg{Database: "db", Table: "t", Type: core.MsgDML, DmlMsg: &core.DMLMsg{Action: core.DeleteAction,
+		Data: map[string]interface{}{"id": 1, "v": "b"}}}
+	trans.IterateTransforms(del)
+	stmt, args, err = o.generateKeylessDeleteSQL(del, router.ColumnsMapper, "db", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt != "DELETE FROM `db`.`t` WHERE `id` <=> ? AND `v` <=> ? AND `src` <=> ? LIMIT 1" ||
+		!reflect.DeepEqual(args, []interface{}{1, "b", "mysql"}) {
+		t.Errorf("delete = %s %v", stmt, args)
+	}
+}
+
+func TestDispatchParallelUniqueKeys(t *testing.T) {
+	router := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t"}
+	router.ColumnsMapper.RowKeys = []string{"id"}
+	router.ColumnsMapper.UniqueKeys = [][]string{{"code"}}
+	k := metas.GenerateMapRouterKey("db", "t")
+	o := &OutputPlugin{MysqlConfig: &config.MysqlConfig{},
+		metas: &core.Metas{Routers: &metas.Routers{Maps: map[string]*metas.Router{k: router}}}}
+	o.Options.ParallelWorkers = 64
+
+	newMsg := func(action core.ActionType, data map[string]interface{}, old map[string]interface{}) *core.Msg {
+		return &core.Msg{Database: "db", Table: "t", Type: core.MsgDML, DmlMsg: &core.DMLMsg{Action: action, Data: data, Old: old}}
+	}
+	// id 1 frees code x, id 2 takes it: applied by one worker in source order
+	free := newMsg(core.UpdateAction, map[string]interface{}{"id": 1, "code": "y"}, map[string]interface{}{"id": 1, "code": "x"})
+	take := newMsg(core.InsertAction, map[string]interface{}{"id": 2, "code": "x"}, nil)
+	msgs := []*core.Msg{free, take}
+	for i := 3; i < 40; i++ {
+		msgs = append(msgs, newMsg(core.InsertAction, map[string]interface{}{"id": i, "code": nil}, nil))
+	}
+	workerTableMsgs, err := o.dispatchParallel(map[string][]*core.Msg{k: msgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := 0
+	for _, tableMsgs := range workerTableMsgs {
+		workerMsgs := tableMsgs[k]
+		if len(workerMsgs) > 0 {
+			used++
+		}
+		for i, msg := range workerMsgs {
+			if msg == take && (i == 0 || workerMsgs[i-1] != free) {
+				t.Errorf("insert taking a freed unique value not after the update on the same worker")
+			}
+		}
+	}
+	// null values do not conflict, other rows still spread over workers
+	if used < 2 {
+		t.Errorf("workers used = %d", used)
+	}
+}
+
+func newTestRouter(policy conflictPolicy, rowKeys []string, columns ...string) *metas.Router {
+	router := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t", ConflictPolicy: string(policy)}
+	if policy == newerWinsConflictPolicy {
+		router.ConflictColumn = "ver"
+	}
+	router.ColumnsMapper.RowKeys = rowKeys
+	router.ColumnsMapper.SourceColumns = columns
+	router.ColumnsMapper.TargetColumns = columns
+	router.ColumnsMapper.MapMapper = make(map[string]string)
+	for _, column := range columns {
+		router.ColumnsMapper.MapMapper[column] = column
+	}
+	router.ColumnsMapper.MapMapperOrder = columns
+	return router
+}
+
+func newTestOutput() *OutputPlugin {
+	return &OutputPlugin{MysqlConfig: &config.MysqlConfig{}, maxAllowedPacket: DefaultMaxAllowedPacket}
+}
+
+func testMsg(action core.ActionType, data map[string]interface{}, old map[string]interface{}) *core.Msg {
+	return &core.Msg{Database: "db", Table: "t", Type: core.MsgDML, DmlMsg: &core.DMLMsg{Action: action, Data: data, Old: old}}
+}
+
+func checkStmts(t *testing.T, name string, stmts []*sqlStmt, want []*sqlStmt) {
+	t.Helper()
+	if len(stmts) != len(want) {
+		for _, stmt := range stmts {
+			t.Logf("%s: %s %v", name, stmt.sql, stmt.args)
+		}
+		t.Fatalf("%s: stmts = %d, want %d", name, len(stmts), len(want))
+	}
+	for i, w := range want {
+		stmt := stmts[i]
+		if stmt.sql != w.sql || !reflect.DeepEqual(stmt.args, w.args) || stmt.rows != w.rows ||
+			stmt.checkAffected != w.checkAffected || stmt.conflictSql != w.conflictSql || !reflect.DeepEqual(stmt.conflictArgs, w.conflictArgs) {
+			t.Errorf("%s: stmt %d = %s %v rows %d check %v conflict %s %v,\nwant %s %v rows %d check %v conflict %s %v", name, i,
+				stmt.sql, stmt.args, stmt.rows, stmt.checkAffected, stmt.conflictSql, stmt.conflictArgs,
+				w.sql, w.args, w.rows, w.checkAffected, w.conflictSql, w.conflictArgs)
+		}
+	}
+}
+
+func TestGenerateUpsertStmts(t *testing.T) {
+	msgs := []*core.Msg{
+		testMsg(core.InsertAction, map[string]interface{}{"id": 1, "v": "a", "ver": 10}, nil),
+		testMsg(core.UpdateAction, map[string]interface{}{"id": 2, "v": "b", "ver": nil}, map[string]interface{}{"id": 2, "v": "x", "ver": 5}),
+		testMsg(core.InsertAction, map[string]interface{}{"id": 3, "v": "c", "ver": 30}, nil),
+	}
+	const upsert = "INSERT INTO `db`.`t` (`id`,`v`,`ver`) VALUES (?,?,?) ON DUPLICATE KEY UPDATE `v` = VALUES(`v`),`ver` = VALUES(`ver`)"
+	const newer = "(`ver` IS NULL OR VALUES(`ver`) >= `ver`)"
+	tests := []struct {
+		policy conflictPolicy
+		want   []*sqlStmt
+	}{
+		// source row always wins
+		{overwriteConflictPolicy, []*sqlStmt{{
+			sql:  "INSERT INTO `db`.`t` (`id`,`v`,`ver`) VALUES (?,?,?),(?,?,?),(?,?,?) ON DUPLICATE KEY UPDATE `v` = VALUES(`v`),`ver` = VALUES(`ver`)",
+			args: []interface{}{1, "a", 10, 2, "b", nil, 3, "c", 30}, rows: 3,
+		}}},
+		// duplicate insert ignored and counted, missing row of an update inserted
+		{ignoreConflictPolicy, []*sqlStmt{
+			{sql: "INSERT IGNORE INTO `db`.`t` (`id`,`v`,`ver`) VALUES (?,?,?)", args: []interface{}{1, "a", 10}, rows: 1, checkAffected: true},
+			{sql: upsert, args: []interface{}{2, "b", nil}, rows: 1},
+			{sql: "INSERT IGNORE INTO `db`.`t` (`id`,`v`,`ver`) VALUES (?,?,?)", args: []interface{}{3, "c", 30}, rows: 1, checkAffected: true},
+		}},
+		// duplicate insert fails on exec, update of a missing row is counted
+		{failConflictPolicy, []*sqlStmt{
+			{sql: "INSERT INTO `db`.`t` (`id`,`v`,`ver`) VALUES (?,?,?)", args: []interface{}{1, "a", 10}, rows: 1},
+			{sql: "UPDATE `db`.`t` SET `id` = ?,`v` = ?,`ver` = ? WHERE `id` = ?", args: []interface{}{2, "b", nil, 2}, rows: 1, checkAffected: true},
+			{sql: "INSERT INTO `db`.`t` (`id`,`v`,`ver`) VALUES (?,?,?)", args: []interface{}{3, "c", 30}, rows: 1},
+		}},
+		// existing row with greater version kept, null version on either side is overwritten
+		{newerWinsConflictPolicy, []*sqlStmt{{
+			sql: "INSERT INTO `db`.`t` (`id`,`v`,`ver`) VALUES (?,?,?),(?,?,?),(?,?,?) ON DUPLICATE KEY UPDATE " +
+				"`v` = IF(" + newer + ", VALUES(`v`), `v`),`ver` = IF(" + newer + ", VALUES(`ver`), `ver`)",
+			args: []interface{}{1, "a", 10, 2, "b", nil, 3, "c", 30}, rows: 3,
+			conflictSql: "SELECT COUNT(*) FROM `db`.`t` AS t JOIN (SELECT ? AS `k0`,? AS `v` UNION ALL SELECT ?,? UNION ALL SELECT ?,?) AS s " +
+				"ON t.`id` = s.`k0` WHERE t.`ver` > s.`v`",
+			conflictArgs: []interface{}{1, 10, 2, nil, 3, 30},
+		}}},
+	}
+	for _, tt := range tests {
+		router := newTestRouter(tt.policy, []string{"id"}, "id", "v", "ver")
+		stmts, err := newTestOutput().generateStmts(msgs, router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStmts(t, string(tt.policy), stmts, tt.want)
+		for _, stmt := range stmts {
+			if stmt.policy != tt.policy || stmt.table != "db.t" {
+				t.Errorf("%s: stmt policy %s table %s", tt.policy, stmt.policy, stmt.table)
+			}
+		}
+	}
+}
+
+func TestGenerateDeleteStmts(t *testing.T) {
+	msgs := []*core.Msg{
+		testMsg(core.DeleteAction, map[string]interface{}{"id": 1, "v": "a", "ver": 10}, nil),
+		testMsg(core.DeleteAction, map[string]interface{}{"id": 2, "v": "b", "ver": nil}, nil),
+	}
+	const bulkDelete = "DELETE FROM `db`.`t` WHERE `id` IN (?,?)"
+	tests := []struct {
+		policy conflictPolicy
+		want   []*sqlStmt
+	}{
+		// missing row is already the wanted state
+		{overwriteConflictPolicy, []*sqlStmt{{sql: bulkDelete, args: []interface{}{1, 2}, rows: 2}}},
+		{ignoreConflictPolicy, []*sqlStmt{{sql: bulkDelete, args: []interface{}{1, 2}, rows: 2, checkAffected: true}}},
+		{failConflictPolicy, []*sqlStmt{{sql: bulkDelete, args: []interface{}{1, 2}, rows: 2, checkAffected: true}}},
+		// row with greater version is not deleted, null target version is deleted,
+		// null source version deletes only a row with null version
+		{newerWinsConflictPolicy, []*sqlStmt{{
+			sql:  "DELETE FROM `db`.`t` WHERE (`id` = ? AND (`ver` IS NULL OR `ver` <= ?)) OR (`id` = ? AND (`ver` IS NULL OR `ver` <= ?))",
+			args: []interface{}{1, 10, 2, nil}, rows: 2, checkAffected: true,
+		}}},
+	}
+	for _, tt := range tests {
+		router := newTestRouter(tt.policy, []string{"id"}, "id", "v", "ver")
+		stmts, err := newTestOutput().generateStmts(msgs, router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStmts(t, string(tt.policy), stmts, tt.want)
+	}
+}
+
+// TestGenerateKeyStmtsCompact changes of a key are merged, unless rows of other keys share a unique key
+func TestGenerateKeyStmtsCompact(t *testing.T) {
+	msgs := []*core.Msg{
+		testMsg(core.UpdateAction, map[string]interface{}{"id": 1, "code": "y"}, map[string]interface{}{"id": 1, "code": "x"}),
+		testMsg(core.InsertAction, map[string]interface{}{"id": 2, "code": "x"}, nil),
+		testMsg(core.UpdateAction, map[string]interface{}{"id": 1, "code": "z"}, map[string]interface{}{"id": 1, "code": "y"}),
+	}
+	const upsert = "INSERT INTO `db`.`t` (`id`,`code`) VALUES "
+	const update = " ON DUPLICATE KEY UPDATE `code` = VALUES(`code`)"
+	o := newTestOutput()
+	o.Options.Compact = true
+	router := newTestRouter(overwriteConflictPolicy, []string{"id"}, "id", "code")
+	stmts, err := o.generateStmts(msgs, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// id 1 merged to its last change, after the insert of id 2
+	checkStmts(t, "compact", stmts, []*sqlStmt{{sql: upsert + "(?,?),(?,?)" + update, args: []interface{}{2, "x", 1, "z"}, rows: 2}})
+
+	// id 2 takes code x freed by id 1, rows keep the source order
+	router.ColumnsMapper.UniqueKeys = [][]string{{"code"}}
+	stmts, err = o.generateStmts(msgs, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStmts(t, "unique key", stmts, []*sqlStmt{{sql: upsert + "(?,?),(?,?),(?,?)" + update,
+		args: []interface{}{1, "y", 2, "x", 1, "z"}, rows: 3}})
+}
+
+func TestValidateConflictPolicy(t *testing.T) {
+	tests := []struct {
+		router *metas.Router
+		ok     bool
+	}{
+		{newTestRouter(overwriteConflictPolicy, []string{"id"}, "id", "v"), true},
+		{newTestRouter(newerWinsConflictPolicy, []string{"id"}, "id", "v", "ver"), true},
+		{newTestRouter(newerWinsConflictPolicy, nil, "id", "v", "ver"), false},        // no row key
+		{newTestRouter(newerWinsConflictPolicy, []string{"id"}, "id", "v"), false},    // conflict-column not mapped
+		{newTestRouter(newerWinsConflictPolicy, []string{"ver"}, "id", "ver"), false}, // conflict-column is a key
+		{newTestRouter("last-wins", []string{"id"}, "id", "v"), false},                // unknown policy
+	}
+	for i, tt := range tests {
+		if err := validateConflictPolicy(tt.router); (err == nil) != tt.ok {
+			t.Errorf("test %d: err = %v", i, err)
+		}
+	}
+}
+
+func TestGenerateBulkDeleteCompositeKey(t *testing.T) {
+	router := newTestRouter(overwriteConflictPolicy, []string{"a", "b"}, "a", "b", "v")
+	router.ColumnsMapper.MapMapper["b"] = "tb"
+	msgs := []*core.Msg{
+		testMsg(core.DeleteAction, map[string]interface{}{"a": 1, "b": "x", "v": 1}, nil),
+		testMsg(core.DeleteAction, map[string]interface{}{"a": 2, "b": "y", "v": 2}, nil),
+	}
+	stmt, args, err := newTestOutput().generateBulkDeleteSQL(msgs, router.ColumnsMapper, "db", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt != "DELETE FROM `db`.`t` WHERE (`a`,`tb`) IN ((?,?),(?,?))" || !reflect.DeepEqual(args, []interface{}{1, "x", 2, "y"}) {
+		t.Errorf("delete = %s %v", stmt, args)
+	}
+	// key column not mapped to target
+	delete(router.ColumnsMapper.MapMapper, "b")
+	if _, _, err = newTestOutput().generateBulkDeleteSQL(msgs, router.ColumnsMapper, "db", "t"); err == nil {
+		t.Errorf("unmapped key column: expected error")
+	}
+}
+
+func TestSplitMsgsByPacket(t *testing.T) {
+	// max_allowed_packet/2 = 100, a 30 byte string key is 34, 2 rows per statement
+	o := newTestOutput()
+	o.maxAllowedPacket = 200
+	router := newTestRouter(overwriteConflictPolicy, []string{"id"}, "id", "v")
+	var msgs []*core.Msg
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, testMsg(core.DeleteAction, map[string]interface{}{"id": fmt.Sprintf("%030d", i), "v": i}, nil))
+	}
+	stmts, err := o.generateStmts(msgs, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 3 || stmts[0].rows != 2 || stmts[1].rows != 2 || stmts[2].rows != 1 ||
+		stmts[2].sql != "DELETE FROM `db`.`t` WHERE `id` IN (?)" || !reflect.DeepEqual(stmts[2].args, []interface{}{fmt.Sprintf("%030d", 4)}) {
+		for _, stmt := range stmts {
+			t.Logf("%s %v", stmt.sql, stmt.args)
+		}
+		t.Errorf("packet split stmts = %d", len(stmts))
+	}
+	// a row over the packet limit is a statement of its own
+	big := testMsg(core.DeleteAction, map[string]interface{}{"id": strings.Repeat("x", 200)}, nil)
+	if split := o.splitMsgsByPacket([]*core.Msg{msgs[0], big, msgs[1]}, []string{"id"}); len(split) != 3 {
+		t.Errorf("big row split = %d", len(split))
+	}
+
+	// composite key binds 2 placeholders per row, 65535 placeholders hold 32767 rows
+	o = newTestOutput()
+	o.maxAllowedPacket = 1 << 30
+	msgs = make([]*core.Msg, 0, MaxPlaceholders/2+1)
+	for i := 0; i < MaxPlaceholders/2+1; i++ {
+		msgs = append(msgs, testMsg(core.DeleteAction, map[string]interface{}{"a": i, "b": i}, nil))
+	}
+	split := o.splitMsgsByPacket(msgs, []string{"a", "b"})
+	if len(split) != 2 || len(split[0]) != MaxPlaceholders/2 || len(split[1]) != 1 {
+		t.Errorf("placeholder split = %d", len(split))
+	}
+}
+
+func TestGenerateKeylessStmts(t *testing.T) {
+	msgs := []*core.Msg{
+		testMsg(core.InsertAction, map[string]interface{}{"a": 1, "b": nil}, nil),
+		testMsg(core.InsertAction, map[string]interface{}{"a": 2, "b": "y"}, nil),
+		testMsg(core.UpdateAction, map[string]interface{}{"a": 2, "b": "z"}, map[string]interface{}{"a": 2, "b": "y"}),
+		testMsg(core.DeleteAction, map[string]interface{}{"a": 1, "b": nil}, nil),
+		testMsg(core.InsertAction, map[string]interface{}{"a": 3, "b": "w"}, nil),
+	}
+	for _, policy := range []conflictPolicy{overwriteConflictPolicy, failConflictPolicy} {
+		// update or delete matching no row is a conflict except under overwrite, inserts never conflict
+		check := policy != overwriteConflictPolicy
+		want := []*sqlStmt{
+			{sql: "INSERT INTO `db`.`t` (`a`,`b`) VALUES (?,?),(?,?)", args: []interface{}{1, nil, 2, "y"}, rows: 2},
+			{sql: "UPDATE `db`.`t` SET `a` = ?,`b` = ? WHERE `a` <=> ? AND `b` <=> ? LIMIT 1",
+				args: []interface{}{2, "z", 2, "y"}, rows: 1, checkAffected: check},
+			{sql: "DELETE FROM `db`.`t` WHERE `a` <=> ? AND `b` <=> ? LIMIT 1", args: []interface{}{1, nil}, rows: 1, checkAffected: check},
+			{sql: "INSERT INTO `db`.`t` (`a`,`b`) VALUES (?,?)", args: []interface{}{3, "w"}, rows: 1},
+		}
+		stmts, err := newTestOutput().generateStmts(msgs, newTestRouter(policy, nil, "a", "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStmts(t, string(policy), stmts, want)
+	}
+	// update without old row image can not be matched
+	update := testMsg(core.UpdateAction, map[string]interface{}{"a": 2, "b": "z"}, nil)
+	if _, err := newTestOutput().generateStmts([]*core.Msg{update}, newTestRouter(overwriteConflictPolicy, nil, "a", "b")); err == nil {
+		t.Errorf("keyless update without old: expected error")
+	}
+}
+
+func TestGenerateCheckpointStmt(t *testing.T) {
+	o := newTestOutput()
+	o.Options.CheckpointTable = "qin_cdc.checkpoint"
+	o.name = "p1"
+	o.lastPosition = "sid:1-5"
+	stmt := o.generateCheckpointStmt()
+	if stmt.sql != "INSERT INTO `qin_cdc`.`checkpoint` (`name`, `position`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `position` = VALUES(`position`)" ||
+		!reflect.DeepEqual(stmt.args, []interface{}{"p1", "sid:1-5"}) {
+		t.Errorf("checkpoint = %s %v", stmt.sql, stmt.args)
+	}
+}
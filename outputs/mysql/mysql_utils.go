@@ -9,30 +9,54 @@ import (
 	"github.com/sqlpub/qin-cdc/config"
 	"github.com/sqlpub/qin-cdc/core"
 	"github.com/sqlpub/qin-cdc/metas"
+	"slices"
 	"strings"
 	"time"
 )
 
+type applyMode string
+
 const (
-	PluginName                 = "mysql"
-	DefaultBatchSize       int = 10240
-	DefaultBatchIntervalMs int = 100
-	RetryCount             int = 3
-	RetryInterval          int = 5
+	PluginName                  = "mysql"
+	DefaultBatchSize        int = 10240
+	DefaultBatchIntervalMs  int = 100
+	RetryCount              int = 3
+	RetryInterval           int = 5
+	DefaultCheckpointTable      = "qin_cdc.checkpoint"
+	DefaultMaxAllowedPacket     = 4 << 20
+	MaxPlaceholders             = 65535
+	DefaultTableWorkers         = 1
+
+	tableApplyMode       applyMode = "table"       // group by table, apply tables concurrently
+	transactionApplyMode applyMode = "transaction" // keep source transaction boundary and order
 )
 
+type sqlStmt struct {
+	sql  string
+	args []interface{}
+	rows int
+	// conflict detection
+	table         string
+	policy        conflictPolicy
+	checkAffected bool   // rows not affected are conflicts, e.g. insert ignore duplicate key, delete missing row
+	conflictSql   string // count conflicts before exec
+	conflictArgs  []interface{}
+}
+
 func getConn(conf *config.MysqlConfig) (db *sql.DB, err error) {
 	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%d)/information_schema?charset=utf8mb4&timeout=3s",
+		"%s:%s@tcp(%s:%d)/information_schema?charset=utf8mb4&timeout=3s&clientFoundRows=true",
 		conf.UserName, conf.Password,
 		conf.Host, conf.Port)
 	db, err = sql.Open("mysql", dsn)
 	if err != nil {
 		return db, err
 	}
+	maxConns := 2
+	maxConns = max(maxConns, conf.Options.ParallelWorkers, conf.Options.TableWorkers)
 	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(2)
-	db.SetMaxIdleConns(2)
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
 	return db, err
 }
 
@@ -43,13 +67,13 @@ func closeConn(db *sql.DB) {
 }
 
 func (o *OutputPlugin) generateBulkInsertOnDuplicateKeyUpdateSQL(msgs []*core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) (string, []interface{}, error) {
-	pks := make(map[string]interface{}, len(columnsMapper.PrimaryKeys))
-	for _, pk := range columnsMapper.PrimaryKeys {
+	pks := make(map[string]interface{}, len(columnsMapper.RowKeys))
+	for _, pk := range columnsMapper.RowKeys {
 		pks[pk] = nil
 	}
 
 	updateColumnsIdx := 0
-	columnNamesAssignWithoutPks := make([]string, len(columnsMapper.MapMapper)-len(columnsMapper.PrimaryKeys))
+	columnNamesAssignWithoutPks := make([]string, len(columnsMapper.MapMapper)-len(columnsMapper.RowKeys))
 	allColumnNamesInSQL := make([]string, 0, len(columnsMapper.MapMapper))
 	allColumnPlaceHolder := make([]string, 0, len(columnsMapper.MapMapper))
 	for _, sourceColumn := range columnsMapper.MapMapperOrder {
@@ -87,48 +111,165 @@ func (o *OutputPlugin) generateBulkInsertOnDuplicateKeyUpdateSQL(msgs []*core.Ms
 	return fmt.Sprintf("%s %s", sqlInsert, sqlUpdate), args, nil
 }
 
-func (o *OutputPlugin) generateSingleDeleteSQL(msg *core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) (string, []interface{}, error) {
-	pks := make(map[string]interface{}, len(columnsMapper.PrimaryKeys))
-	for _, pk := range columnsMapper.PrimaryKeys {
-		pks[pk] = nil
+// generateBulkDeleteSQL delete by target key columns, one key: `a` IN (?,?), composite key: (`a`,`b`) IN ((?,?),(?,?))
+func (o *OutputPlugin) generateBulkDeleteSQL(msgs []*core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) (string, []interface{}, error) {
+	targetPks := make([]string, 0, len(columnsMapper.RowKeys))
+	for _, pk := range columnsMapper.RowKeys {
+		targetPk, ok := columnsMapper.MapMapper[pk]
+		if !ok {
+			return "", nil, errors.Errorf("primary key %s is not mapped to target column", pk)
+		}
+		targetPks = append(targetPks, fmt.Sprintf("`%s`", targetPk))
+	}
+	placeHolder := strings.TrimSuffix(strings.Repeat("?,", len(targetPks)), ",")
+	if len(targetPks) > 1 {
+		placeHolder = fmt.Sprintf("(%s)", placeHolder)
 	}
 
 	var whereSql []string
-	var args []interface{}
-	for sourceColumn, targetColumn := range columnsMapper.MapMapper {
-		pkData, ok := pks[sourceColumn]
-		if !ok {
-			continue
+	args := make([]interface{}, 0, len(msgs)*len(targetPks))
+	for _, msg := range msgs {
+		for _, pk := range columnsMapper.RowKeys {
+			pkData, ok := msg.DmlMsg.Data[pk]
+			if !ok {
+				return "", nil, errors.Errorf("delete row data missing primary key %s", pk)
+			}
+			args = append(args, pkData)
 		}
-		whereSql = append(whereSql, fmt.Sprintf("`%s` = ?", targetColumn))
-		args = append(args, pkData)
+		whereSql = append(whereSql, placeHolder)
 	}
 	if len(whereSql) == 0 {
 		return "", nil, errors.Errorf("where sql is empty, probably missing pk")
 	}
 
-	stmt := fmt.Sprintf("DELETE FROM `%s`.`%s` WHERE %s", targetSchema, targetTable, strings.Join(whereSql, " AND "))
+	targetPkNames := strings.Join(targetPks, ",")
+	if len(targetPks) > 1 {
+		targetPkNames = fmt.Sprintf("(%s)", targetPkNames)
+	}
+	stmt := fmt.Sprintf("DELETE FROM `%s`.`%s` WHERE %s IN (%s)", targetSchema, targetTable, targetPkNames, strings.Join(whereSql, ","))
 	return stmt, args, nil
 }
 
-func (o *OutputPlugin) generateBulkDeleteSQL(msgs []*core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) (string, []interface{}, error) {
-	pkName := columnsMapper.PrimaryKeys[0]
-	var whereSql []string
-	var args []interface{}
+// splitMsgsByPacket split msgs so that a statement binding the columns of each msg stays within
+// max_allowed_packet and the placeholder limit
+func (o *OutputPlugin) splitMsgsByPacket(msgs []*core.Msg, columns []string) [][]*core.Msg {
+	maxPacket := o.maxAllowedPacket / 2 // leave room for sql text and protocol overhead
+	msgsList := make([][]*core.Msg, 0)
+	tmpMsgs := make([]*core.Msg, 0)
+	size := 0
 	for _, msg := range msgs {
-		pkData, ok := msg.DmlMsg.Data[pkName]
-		if !ok {
-			continue
+		rowSize := 0
+		for _, column := range columns {
+			rowSize += valueSize(msg.DmlMsg.Data[column])
+		}
+		if len(tmpMsgs) > 0 && (size+rowSize > maxPacket || (len(tmpMsgs)+1)*len(columns) > MaxPlaceholders) {
+			msgsList = append(msgsList, tmpMsgs)
+			tmpMsgs = make([]*core.Msg, 0)
+			size = 0
 		}
-		whereSql = append(whereSql, "?")
-		args = append(args, pkData)
+		tmpMsgs = append(tmpMsgs, msg)
+		size += rowSize
+	}
+	if len(tmpMsgs) > 0 {
+		msgsList = append(msgsList, tmpMsgs)
+	}
+	return msgsList
+}
 
+// valueSize estimated size of a bound value and its placeholder in sql
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v) + 4
+	case []byte:
+		return len(v) + 4
+	default:
+		return 16
 	}
-	targetPkName := columnsMapper.MapMapper[pkName]
-	if len(whereSql) == 0 {
-		return "", nil, errors.Errorf("where sql is empty, probably missing pk")
+}
+
+func getMaxAllowedPacket(db *sql.DB) int {
+	var maxAllowedPacket int
+	err := db.QueryRow("SELECT @@max_allowed_packet").Scan(&maxAllowedPacket)
+	if err != nil || maxAllowedPacket <= 0 {
+		log.Warnf("output %s get max_allowed_packet failed, use default %d, err: %v", PluginName, DefaultMaxAllowedPacket, err)
+		return DefaultMaxAllowedPacket
+	}
+	return maxAllowedPacket
+}
+
+func (o *OutputPlugin) generateBulkInsertSQL(msgs []*core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string, ignore bool) (string, []interface{}, error) {
+	allColumnNamesInSQL := make([]string, 0, len(columnsMapper.MapMapper))
+	allColumnPlaceHolder := make([]string, 0, len(columnsMapper.MapMapper))
+	for _, sourceColumn := range columnsMapper.MapMapperOrder {
+		allColumnNamesInSQL = append(allColumnNamesInSQL, fmt.Sprintf("`%s`", columnsMapper.MapMapper[sourceColumn]))
+		allColumnPlaceHolder = append(allColumnPlaceHolder, "?")
+	}
+	valuesSql := make([]string, 0, len(msgs))
+	args := make([]interface{}, 0, len(columnsMapper.MapMapper)*len(msgs))
+	for _, msg := range msgs {
+		for _, sourceColumn := range columnsMapper.MapMapperOrder {
+			args = append(args, msg.DmlMsg.Data[sourceColumn])
+		}
+		valuesSql = append(valuesSql, fmt.Sprintf("(%s)", strings.Join(allColumnPlaceHolder, ",")))
+	}
+	insert := "INSERT"
+	if ignore {
+		insert = "INSERT IGNORE"
+	}
+	stmt := fmt.Sprintf("%s INTO `%s`.`%s` (%s) VALUES %s",
+		insert,
+		targetSchema,
+		targetTable,
+		strings.Join(allColumnNamesInSQL, ","),
+		strings.Join(valuesSql, ","))
+	return stmt, args, nil
+}
+
+// generateKeylessUpdateSQL table without key, match one row by full old row image
+func (o *OutputPlugin) generateKeylessUpdateSQL(msg *core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) (string, []interface{}, error) {
+	setSql := make([]string, 0, len(columnsMapper.MapMapperOrder))
+	args := make([]interface{}, 0, len(columnsMapper.MapMapperOrder)*2)
+	for _, sourceColumn := range columnsMapper.MapMapperOrder {
+		setSql = append(setSql, fmt.Sprintf("`%s` = ?", columnsMapper.MapMapper[sourceColumn]))
+		args = append(args, msg.DmlMsg.Data[sourceColumn])
 	}
+	whereSql, whereArgs, err := generateRowImageWhere(msg.DmlMsg.Old, columnsMapper)
+	if err != nil {
+		return "", nil, err
+	}
+	args = append(args, whereArgs...)
+	stmt := fmt.Sprintf("UPDATE `%s`.`%s` SET %s WHERE %s LIMIT 1", targetSchema, targetTable, strings.Join(setSql, ","), whereSql)
+	return stmt, args, nil
+}
 
-	stmt := fmt.Sprintf("DELETE FROM `%s`.`%s` WHERE `%s` IN (%s)", targetSchema, targetTable, targetPkName, strings.Join(whereSql, ","))
+// generateKeylessDeleteSQL table without key, match one row by full row image
+func (o *OutputPlugin) generateKeylessDeleteSQL(msg *core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) (string, []interface{}, error) {
+	whereSql, args, err := generateRowImageWhere(msg.DmlMsg.Data, columnsMapper)
+	if err != nil {
+		return "", nil, err
+	}
+	stmt := fmt.Sprintf("DELETE FROM `%s`.`%s` WHERE %s LIMIT 1", targetSchema, targetTable, whereSql)
 	return stmt, args, nil
 }
+
+// generateRowImageWhere null-safe equal on all mapped columns, except columns of event metadata values,
+// their stored value is of the event that wrote the row, not of this event
+func generateRowImageWhere(row map[string]interface{}, columnsMapper metas.ColumnsMapper) (string, []interface{}, error) {
+	if row == nil {
+		return "", nil, errors.Errorf("where sql is empty, row image is nil")
+	}
+	whereSql := make([]string, 0, len(columnsMapper.MapMapperOrder))
+	args := make([]interface{}, 0, len(columnsMapper.MapMapperOrder))
+	for _, sourceColumn := range columnsMapper.MapMapperOrder {
+		if slices.Contains(columnsMapper.MetaColumns, sourceColumn) {
+			continue
+		}
+		whereSql = append(whereSql, fmt.Sprintf("`%s` <=> ?", columnsMapper.MapMapper[sourceColumn]))
+		args = append(args, row[sourceColumn])
+	}
+	if len(whereSql) == 0 {
+		return "", nil, errors.Errorf("where sql is empty, no mapped columns")
+	}
+	return strings.Join(whereSql, " AND "), args, nil
+}
@@ -2,30 +2,20 @@ package starrocks
 
 import (
 	"fmt"
-	"github.com/juju/errors"
 	"github.com/mitchellh/mapstructure"
-	"github.com/siddontang/go-log/log"
 	"github.com/sqlpub/qin-cdc/config"
 	"github.com/sqlpub/qin-cdc/core"
 	"github.com/sqlpub/qin-cdc/metas"
-	"github.com/sqlpub/qin-cdc/metrics"
-	"io"
+	"github.com/sqlpub/qin-cdc/outputs/streamload"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 )
 
 type OutputPlugin struct {
 	*config.StarrocksConfig
-	Done         chan bool
-	metas        *core.Metas
-	msgTxnBuffer struct {
-		size        int
-		tableMsgMap map[string][]*core.Msg
-	}
-	client       *http.Client
-	transport    *http.Transport
-	lastPosition string
+	streamLoad *streamload.Output
+	name       string
 }
 
 func (o *OutputPlugin) Configure(conf map[string]interface{}) error {
@@ -38,8 +28,6 @@ func (o *OutputPlugin) Configure(conf map[string]interface{}) error {
 }
 
 func (o *OutputPlugin) NewOutput(metas *core.Metas) {
-	o.Done = make(chan bool)
-	o.metas = metas
 	// options handle
 	if o.StarrocksConfig.Options.BatchSize == 0 {
 		o.StarrocksConfig.Options.BatchSize = DefaultBatchSize
@@ -47,133 +35,60 @@ func (o *OutputPlugin) NewOutput(metas *core.Metas) {
 	if o.StarrocksConfig.Options.BatchIntervalMs == 0 {
 		o.StarrocksConfig.Options.BatchIntervalMs = DefaultBatchIntervalMs
 	}
-	o.msgTxnBuffer.size = 0
-	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
-
-	o.transport = &http.Transport{}
-	o.client = &http.Client{
-		Transport: o.transport,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			req.Header.Add("Authorization", "Basic "+o.auth())
-			// log.Debugf("重定向请求到be: %v", req.URL)
-			return nil // return nil nil回重定向。
-		},
+	if o.StarrocksConfig.Options.MergeCommitIntervalMs == 0 {
+		o.StarrocksConfig.Options.MergeCommitIntervalMs = DefaultMergeCommitIntervalMs
 	}
+	if o.StarrocksConfig.Options.MergeCommitParallel == 0 {
+		o.StarrocksConfig.Options.MergeCommitParallel = DefaultMergeCommitParallel
+	}
+	o.streamLoad = streamload.NewOutput(&dialect{
+		mergeCommitIntervalMs: o.Options.MergeCommitIntervalMs,
+		mergeCommitParallel:   o.Options.MergeCommitParallel,
+	}, &streamload.Config{
+		Name:            o.name,
+		Host:            o.Host,
+		LoadPort:        o.LoadPort,
+		UserName:        o.UserName,
+		Password:        o.Password,
+		BatchSize:       o.Options.BatchSize,
+		BatchIntervalMs: o.Options.BatchIntervalMs,
+		TwoPhaseCommit:  o.Options.TwoPhaseCommit,
+		PartialUpdate:   o.Options.PartialUpdate,
+		Format:          o.Options.Format,
+		ColumnSeparator: o.Options.ColumnSeparator,
+		RowDelimiter:    o.Options.RowDelimiter,
+		Compress:        o.Options.Compress,
+		Compact:         o.Options.Compact,
+
+		GroupCommit:        o.Options.MergeCommit,
+		MaxConcurrentLoads: o.Options.MaxConcurrentLoads,
+		MaxBatchIntervalMs: o.Options.MaxBatchIntervalMs,
+	}, metas)
 }
 
-func (o *OutputPlugin) Start(out chan *core.Msg, pos core.Position) {
-	// first pos
-	o.lastPosition = pos.Get()
-	go func() {
-		ticker := time.NewTicker(time.Millisecond * time.Duration(o.Options.BatchIntervalMs))
-		defer ticker.Stop()
-		for {
-			select {
-			case data := <-out:
-				switch data.Type {
-				case core.MsgCtl:
-					o.lastPosition = data.InputContext.Pos
-				case core.MsgDML:
-					o.appendMsgTxnBuffer(data)
-					if o.msgTxnBuffer.size >= o.StarrocksConfig.Options.BatchSize {
-						o.flushMsgTxnBuffer(pos)
-					}
-				}
-			case <-ticker.C:
-				o.flushMsgTxnBuffer(pos)
-			case <-o.Done:
-				o.flushMsgTxnBuffer(pos)
-				return
-			}
-
-		}
-	}()
-}
-
-func (o *OutputPlugin) Close() {
-	log.Infof("output is closing...")
-	close(o.Done)
-	<-o.Done
-	log.Infof("output is closed")
+func (o *OutputPlugin) SetName(name string) {
+	o.name = name
 }
 
-func (o *OutputPlugin) appendMsgTxnBuffer(msg *core.Msg) {
-	key := metas.GenerateMapRouterKey(msg.Database, msg.Table)
-	o.msgTxnBuffer.tableMsgMap[key] = append(o.msgTxnBuffer.tableMsgMap[key], msg)
-	o.msgTxnBuffer.size += 1
+func (o *OutputPlugin) Start(out chan *core.Msg, pos core.Position) {
+	o.streamLoad.Start(out, pos)
 }
 
-func (o *OutputPlugin) flushMsgTxnBuffer(pos core.Position) {
-	defer func() {
-		// flush position
-		err := pos.Update(o.lastPosition)
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-	}()
-
-	if o.msgTxnBuffer.size == 0 {
-		return
-	}
-	// table level export
-	for k, msgs := range o.msgTxnBuffer.tableMsgMap {
-		columnsMapper := o.metas.Routers.Maps[k].ColumnsMapper
-		targetSchema := o.metas.Routers.Maps[k].TargetSchema
-		targetTable := o.metas.Routers.Maps[k].TargetTable
-		err := o.execute(msgs, columnsMapper, targetSchema, targetTable)
-		if err != nil {
-			log.Fatalf("do %s bulk err %v", PluginName, err)
-		}
-	}
-	o.clearMsgTxnBuffer()
+func (o *OutputPlugin) Close() {
+	o.streamLoad.Close()
 }
 
-func (o *OutputPlugin) clearMsgTxnBuffer() {
-	o.msgTxnBuffer.size = 0
-	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
+// dialect starrocks stream load, primary key model load with __op column
+type dialect struct {
+	mergeCommitIntervalMs int
+	mergeCommitParallel   int
 }
 
-func (o *OutputPlugin) execute(msgs []*core.Msg, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) error {
-	if len(msgs) == 0 {
-		return nil
-	}
-	var jsonList []string
-
-	jsonList = o.generateJson(msgs)
-	for _, s := range jsonList {
-		log.Debugf("%s load %s.%s row data: %v", PluginName, targetSchema, targetTable, s)
-	}
-	log.Debugf("%s bulk load %s.%s row data num: %d", PluginName, targetSchema, targetTable, len(jsonList))
-	var err error
-	for i := 0; i < RetryCount; i++ {
-		err = o.sendData(jsonList, columnsMapper, targetSchema, targetTable)
-		if err != nil {
-			log.Warnf("send data failed, err: %v, execute retry...", err.Error())
-			if i+1 == RetryCount {
-				break
-			}
-			time.Sleep(time.Duration(RetryInterval*(i+1)) * time.Second)
-			continue
-		}
-		break
-	}
-	return err
+func (d *dialect) Name() string {
+	return PluginName
 }
 
-func (o *OutputPlugin) sendData(content []string, columnsMapper metas.ColumnsMapper, targetSchema string, targetTable string) error {
-	loadUrl := fmt.Sprintf("http://%s:%d/api/%s/%s/_stream_load",
-		o.Host, o.LoadPort, targetSchema, targetTable)
-	newContent := `[` + strings.Join(content, ",") + `]`
-	req, _ := http.NewRequest("PUT", loadUrl, strings.NewReader(newContent))
-
-	// req.Header.Add
-	req.Header.Add("Authorization", "Basic "+o.auth())
-	req.Header.Add("Expect", "100-continue")
-	req.Header.Add("strict_mode", "true")
-	// req.Header.Add("label", "39c25a5c-7000-496e-a98e-348a264c81de")
-	req.Header.Add("format", "json")
-	req.Header.Add("strip_outer_array", "true")
-
+func (d *dialect) SetHeaders(req *http.Request, columnsMapper metas.ColumnsMapper) {
 	var columnArray []string
 	for _, column := range columnsMapper.SourceColumns {
 		columnArray = append(columnArray, column)
@@ -181,28 +96,35 @@ func (o *OutputPlugin) sendData(content []string, columnsMapper metas.ColumnsMap
 	columnArray = append(columnArray, DeleteColumn)
 	columns := fmt.Sprintf("%s, __op = %s", strings.Join(columnArray, ","), DeleteColumn)
 	req.Header.Add("columns", columns)
+}
 
-	response, err := o.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
-	returnMap, err := o.parseResponse(response)
-	if err != nil {
-		return err
+// SetPartialHeaders primary key model partial update
+func (d *dialect) SetPartialHeaders(req *http.Request, columns []string) {
+	req.Header.Add("partial_update", "true")
+	req.Header.Add("columns", strings.Join(columns, ","))
+}
+
+// SetFormatHeaders csv with enclose and escape
+func (d *dialect) SetFormatHeaders(req *http.Request, conf *streamload.Config) {
+	if conf.Format == streamload.FormatCsv {
+		req.Header.Add("format", "CSV")
+		req.Header.Add("column_separator", streamload.HeaderSeparator(conf.ColumnSeparator))
+		req.Header.Add("row_delimiter", streamload.HeaderSeparator(conf.RowDelimiter))
+		req.Header.Add("enclose", streamload.CsvEnclose)
+		req.Header.Add("escape", streamload.CsvEscape)
 	}
-	if returnMap["Status"] != "Success" {
-		message := returnMap["Message"]
-		errorUrl := returnMap["ErrorURL"]
-		errorMsg := message.(string) +
-			fmt.Sprintf(", targetTable: %s.%s", targetSchema, targetTable) +
-			fmt.Sprintf(", visit ErrorURL to view error details, ErrorURL: %s", errorUrl)
-		return errors.New(errorMsg)
+	switch conf.Compress {
+	case streamload.CompressGzip:
+		req.Header.Add("compression", "gzip")
+	case streamload.CompressLz4:
+		req.Header.Add("compression", "lz4_frame")
 	}
-	// prom write event number counter
-	numberLoadedRows := returnMap["NumberLoadedRows"]
-	metrics.OpsWriteProcessed.Add(numberLoadedRows.(float64))
-	return nil
+}
+
+// SetGroupCommitHeaders merge commit of loads, async mode returns before the merged load committed
+func (d *dialect) SetGroupCommitHeaders(req *http.Request, mode string) {
+	req.Header.Add("enable_merge_commit", "true")
+	req.Header.Add("merge_commit_interval_ms", strconv.Itoa(d.mergeCommitIntervalMs))
+	req.Header.Add("merge_commit_parallel", strconv.Itoa(d.mergeCommitParallel))
+	req.Header.Add("merge_commit_async", strconv.FormatBool(mode == streamload.GroupCommitAsync))
 }
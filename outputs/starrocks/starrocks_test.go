@@ -0,0 +1,52 @@
+package starrocks
+
+import (
+	"github.com/sqlpub/qin-cdc/metas"
+	"github.com/sqlpub/qin-cdc/outputs/streamload"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestDialectHeaders starrocks headers of a load, engine headers are tested in streamload
+func TestDialectHeaders(t *testing.T) {
+	d := &dialect{mergeCommitIntervalMs: DefaultMergeCommitIntervalMs, mergeCommitParallel: DefaultMergeCommitParallel}
+	tests := []struct {
+		name string
+		set  func(req *http.Request)
+		want http.Header
+	}{
+		{"upsert delete", func(req *http.Request) {
+			d.SetHeaders(req, metas.ColumnsMapper{SourceColumns: []string{"id", "v"}})
+		}, http.Header{"Columns": {"id,v,_delete_sign_, __op = _delete_sign_"}}},
+		{"partial", func(req *http.Request) {
+			d.SetPartialHeaders(req, []string{"id", "v"})
+		}, http.Header{"Partial_update": {"true"}, "Columns": {"id,v"}}},
+		{"json", func(req *http.Request) {
+			d.SetFormatHeaders(req, &streamload.Config{Format: streamload.FormatJson})
+		}, http.Header{}},
+		{"json gzip", func(req *http.Request) {
+			d.SetFormatHeaders(req, &streamload.Config{Format: streamload.FormatJson, Compress: streamload.CompressGzip})
+		}, http.Header{"Compression": {"gzip"}}},
+		{"csv lz4", func(req *http.Request) {
+			d.SetFormatHeaders(req, &streamload.Config{Format: streamload.FormatCsv, ColumnSeparator: "\t",
+				RowDelimiter: "\n", Compress: streamload.CompressLz4})
+		}, http.Header{"Format": {"CSV"}, "Column_separator": {`\x09`}, "Row_delimiter": {`\x0a`},
+			"Enclose": {`"`}, "Escape": {`\`}, "Compression": {"lz4_frame"}}},
+		{"merge commit async", func(req *http.Request) {
+			d.SetGroupCommitHeaders(req, streamload.GroupCommitAsync)
+		}, http.Header{"Enable_merge_commit": {"true"}, "Merge_commit_interval_ms": {"1000"},
+			"Merge_commit_parallel": {"3"}, "Merge_commit_async": {"true"}}},
+		{"merge commit sync", func(req *http.Request) {
+			(&dialect{mergeCommitIntervalMs: 500, mergeCommitParallel: 2}).SetGroupCommitHeaders(req, streamload.GroupCommitSync)
+		}, http.Header{"Enable_merge_commit": {"true"}, "Merge_commit_interval_ms": {"500"},
+			"Merge_commit_parallel": {"2"}, "Merge_commit_async": {"false"}}},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("PUT", "http://fe:8030/api/db/t/_stream_load", nil)
+		tt.set(req)
+		if !reflect.DeepEqual(req.Header, tt.want) {
+			t.Errorf("%s: headers = %v, want %v", tt.name, req.Header, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package starrocks
+
+import (
+	"github.com/juju/errors"
+	"github.com/sqlpub/qin-cdc/outputs/streamload"
+)
+
+const (
+	txnBeginPath    = "/api/transaction/begin"
+	txnLoadPath     = "/api/transaction/load"
+	txnPreparePath  = "/api/transaction/prepare"
+	txnCommitPath   = "/api/transaction/commit"
+	txnRollbackPath = "/api/transaction/rollback"
+)
+
+// Prepare transaction stream load: begin, load, prepare, data is invisible until commit
+func (d *dialect) Prepare(o *streamload.Output, load *streamload.Load) error {
+	returnMap, err := d.txnOperation(o, load, txnBeginPath)
+	if err != nil {
+		return err
+	}
+	switch returnMap["Status"] {
+	case "OK", "Success":
+		if txnId, ok := returnMap["TxnId"].(float64); ok {
+			load.TxnId = int64(txnId)
+		}
+	case "LABEL_ALREADY_EXISTS":
+		switch returnMap["ExistingJobStatus"] {
+		case "FINISHED", "VISIBLE", "COMMITTED":
+			load.Committed = true
+			return nil
+		}
+		// begun by a previous attempt, roll it back and load again
+		if err = d.Abort(o, load); err != nil {
+			return err
+		}
+		return errors.Errorf("begin load %s label already exists, existing transaction rolled back", load.Label)
+	default:
+		return errors.Errorf("begin load %s failed, message: %v", load.Label, returnMap["Message"])
+	}
+
+	req := o.NewLoadRequest("PUT", txnLoadPath, load)
+	req.Header.Add("db", load.TargetSchema)
+	req.Header.Add("table", load.TargetTable)
+	returnMap, err = o.Send(req)
+	if err != nil {
+		return err
+	}
+	if !txnSucceeded(returnMap) {
+		return streamload.LoadError(returnMap, load)
+	}
+	return d.checkedTxnOperation(o, load, txnPreparePath)
+}
+
+func (d *dialect) Commit(o *streamload.Output, load *streamload.Load) error {
+	return d.checkedTxnOperation(o, load, txnCommitPath)
+}
+
+func (d *dialect) Abort(o *streamload.Output, load *streamload.Load) error {
+	return d.checkedTxnOperation(o, load, txnRollbackPath)
+}
+
+func (d *dialect) checkedTxnOperation(o *streamload.Output, load *streamload.Load, path string) error {
+	returnMap, err := d.txnOperation(o, load, path)
+	if err != nil {
+		return err
+	}
+	if !txnSucceeded(returnMap) {
+		return errors.Errorf("%s load %s failed, message: %v", path, load.Label, returnMap["Message"])
+	}
+	return nil
+}
+
+func (d *dialect) txnOperation(o *streamload.Output, load *streamload.Load, path string) (map[string]interface{}, error) {
+	req := o.NewRequest("POST", path, nil)
+	req.Header.Add("label", load.Label)
+	req.Header.Add("db", load.TargetSchema)
+	req.Header.Add("table", load.TargetTable)
+	return o.Send(req)
+}
+
+func txnSucceeded(returnMap map[string]interface{}) bool {
+	return returnMap["Status"] == "OK" || returnMap["Status"] == "Success"
+}
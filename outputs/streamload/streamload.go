@@ -0,0 +1,461 @@
+package streamload
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"github.com/sqlpub/qin-cdc/metrics"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Dialect stream load target specific hooks
+type Dialect interface {
+	// Name output plugin name
+	Name() string
+	// SetHeaders target specific load headers, e.g. delete condition and columns
+	SetHeaders(req *http.Request, columnsMapper metas.ColumnsMapper)
+	// SetFormatHeaders target specific csv separators and compression headers
+	SetFormatHeaders(req *http.Request, conf *Config)
+}
+
+// TxnDialect optional, two phase commit, loads of all tables in a flush are prepared, then committed together
+type TxnDialect interface {
+	// Prepare load content in a transaction not visible until commit, set load TxnId,
+	// set load Committed if the label was committed before
+	Prepare(o *Output, load *Load) error
+	Commit(o *Output, load *Load) error
+	Abort(o *Output, load *Load) error
+}
+
+// PartialDialect optional, partial column update, updates load only the changed columns
+type PartialDialect interface {
+	// SetPartialHeaders target specific partial update load headers of columns
+	SetPartialHeaders(req *http.Request, columns []string)
+}
+
+// GroupCommitDialect optional, target merges small loads of a table into one version, loads have no label
+type GroupCommitDialect interface {
+	// SetGroupCommitHeaders target specific group commit headers of mode async or sync
+	SetGroupCommitHeaders(req *http.Request, mode string)
+}
+
+// Load one table batch
+type Load struct {
+	Label         string
+	TargetSchema  string
+	TargetTable   string
+	ColumnsMapper metas.ColumnsMapper
+	Content       []string
+	TxnId         int64
+	Committed     bool
+
+	// PartialColumns columns of a partial update load, nil for full rows
+	PartialColumns []string
+}
+
+type Config struct {
+	Name            string // pipeline name, label prefix
+	Host            string
+	LoadPort        int
+	UserName        string
+	Password        string
+	BatchSize       int
+	BatchIntervalMs int
+	TwoPhaseCommit  bool
+	PartialUpdate   bool
+	Format          string // json or csv
+	ColumnSeparator string // csv column separator, \x01 hex form allowed
+	RowDelimiter    string // csv row delimiter, \x02 hex form allowed
+	Compress        string // gzip or lz4, empty for none
+	Compact         bool   // merge changes of a primary key in a batch
+
+	GroupCommit        string // async or sync, empty for none
+	MaxConcurrentLoads int    // concurrent table loads of a flush
+	MaxBatchIntervalMs int    // flush interval grows up to it when loads are slow
+}
+
+// Output stream load engine, buffer msgs by table and load them in batches
+type Output struct {
+	Done         chan bool
+	dialect      Dialect
+	conf         *Config
+	metas        *core.Metas
+	msgTxnBuffer struct {
+		size        int
+		tableMsgMap map[string][]*core.Msg
+	}
+	txnMsgs      []*core.Msg // current source transaction msgs, batches hold complete transactions only
+	txnLoadId    int         // load of a source transaction over batch size loaded in parts, 0 if loaded whole
+	client       *http.Client
+	transport    *http.Transport
+	lastPosition string
+	scheduler    *scheduler
+}
+
+func NewOutput(dialect Dialect, conf *Config, metas *core.Metas) *Output {
+	o := &Output{
+		Done:    make(chan bool),
+		dialect: dialect,
+		conf:    conf,
+		metas:   metas,
+	}
+	o.msgTxnBuffer.size = 0
+	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
+	if _, ok := dialect.(TxnDialect); conf.TwoPhaseCommit && !ok {
+		log.Fatalf("output %s does not support two phase commit", dialect.Name())
+	}
+	if _, ok := dialect.(PartialDialect); conf.PartialUpdate && !ok {
+		log.Fatalf("output %s does not support partial update", dialect.Name())
+	}
+	if err := conf.initFormat(); err != nil {
+		log.Fatalf("output %s %v", dialect.Name(), err)
+	}
+	if conf.PartialUpdate && conf.TwoPhaseCommit {
+		// partial rows are merged with rows visible at load time, prepared loads are not visible yet
+		log.Fatalf("output %s partial update can not be used with two phase commit", dialect.Name())
+	}
+	if err := conf.checkGroupCommit(dialect); err != nil {
+		log.Fatalf("output %s %v", dialect.Name(), err)
+	}
+	o.scheduler = newScheduler(conf.MaxConcurrentLoads, conf.BatchIntervalMs, conf.MaxBatchIntervalMs)
+
+	o.transport = &http.Transport{}
+	o.client = &http.Client{
+		Transport: o.transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			req.Header.Add("Authorization", "Basic "+o.auth())
+			// log.Debugf("重定向请求到be: %v", req.URL)
+			return nil // return nil nil回重定向。
+		},
+	}
+	return o
+}
+
+func (o *Output) Start(out chan *core.Msg, pos core.Position) {
+	// first pos
+	o.lastPosition = pos.Get()
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * time.Duration(o.conf.BatchIntervalMs))
+		defer ticker.Stop()
+		for {
+			select {
+			case data := <-out:
+				switch data.Type {
+				case core.MsgCtl:
+					// xid or commit, source transaction completed
+					o.lastPosition = data.InputContext.Pos
+					if o.txnLoadId > 0 {
+						// last part of a large source transaction, position advanced after it is loaded
+						o.flushTxnPart(pos)
+						o.txnLoadId = 0
+						ticker.Reset(o.scheduler.interval)
+						continue
+					}
+					o.appendTxnMsgs()
+					if o.msgTxnBuffer.size >= o.conf.BatchSize {
+						o.flushMsgTxnBuffer(pos)
+						ticker.Reset(o.scheduler.interval)
+					}
+				case core.MsgDML:
+					o.txnMsgs = append(o.txnMsgs, data)
+					if len(o.txnMsgs) >= o.conf.BatchSize {
+						// source transaction over batch size, load it in parts, position not advanced until its xid
+						o.flushMsgTxnBuffer(pos)
+						o.flushTxnPart(pos)
+						ticker.Reset(o.scheduler.interval)
+					}
+				}
+			case <-ticker.C:
+				o.flushMsgTxnBuffer(pos)
+				ticker.Reset(o.scheduler.interval)
+			case <-o.Done:
+				o.flushMsgTxnBuffer(pos)
+				return
+			}
+
+		}
+	}()
+}
+
+func (o *Output) Close() {
+	log.Infof("output is closing...")
+	close(o.Done)
+	<-o.Done
+	log.Infof("output is closed")
+}
+
+// appendTxnMsgs source transaction completed, move its msgs to the batch buffer
+func (o *Output) appendTxnMsgs() {
+	for _, msg := range o.txnMsgs {
+		o.appendMsgTxnBuffer(msg)
+	}
+	o.txnMsgs = make([]*core.Msg, 0)
+}
+
+// flushTxnPart load pending msgs of the current source transaction as its next part,
+// parts are cut at batch size from the transaction start, a replay after restart gets the same parts and labels
+func (o *Output) flushTxnPart(pos core.Position) {
+	o.txnLoadId++
+	o.appendTxnMsgs()
+	o.flushMsgTxnBuffer(pos)
+}
+
+func (o *Output) appendMsgTxnBuffer(msg *core.Msg) {
+	key := metas.GenerateMapRouterKey(msg.Database, msg.Table)
+	o.msgTxnBuffer.tableMsgMap[key] = append(o.msgTxnBuffer.tableMsgMap[key], msg)
+	o.msgTxnBuffer.size += 1
+}
+
+func (o *Output) flushMsgTxnBuffer(pos core.Position) {
+	defer func() {
+		// flush position
+		err := pos.Update(o.lastPosition)
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+	}()
+
+	if o.msgTxnBuffer.size == 0 {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		o.scheduler.observe(time.Since(start))
+	}()
+	if o.conf.TwoPhaseCommit {
+		err := o.executeTxn(o.msgTxnBuffer.tableMsgMap)
+		if err != nil {
+			log.Fatalf("do %s two phase commit err %v", o.dialect.Name(), err)
+		}
+		o.clearMsgTxnBuffer()
+		return
+	}
+	// table level export, loads of all routers share the scheduler concurrency
+	tasks := make([]func() error, 0, len(o.msgTxnBuffer.tableMsgMap))
+	for k, msgs := range o.msgTxnBuffer.tableMsgMap {
+		router := o.metas.Routers.Maps[k]
+		tasks = append(tasks, func() error {
+			return o.execute(msgs, router)
+		})
+	}
+	if err := o.scheduler.run(tasks); err != nil {
+		// position is not advanced, resume from the last flushed position
+		log.Fatalf("do %s bulk err %v", o.dialect.Name(), err)
+	}
+	o.clearMsgTxnBuffer()
+}
+
+func (o *Output) clearMsgTxnBuffer() {
+	o.msgTxnBuffer.size = 0
+	o.msgTxnBuffer.tableMsgMap = make(map[string][]*core.Msg)
+}
+
+// newLoad table msgs to load content, same msgs get the same label
+func (o *Output) newLoad(msgs []*core.Msg, router *metas.Router) *Load {
+	label := generateLabel(o.conf.Name, router.TargetSchema, router.TargetTable, msgs, o.txnLoadId, 0)
+	// primary key changed update, delete old key row before upsert new key row
+	msgs = core.SplitPrimaryKeyChange(msgs, router.ColumnsMapper.PrimaryKeys)
+	msgs = o.compactMsgs(msgs, router)
+	return o.buildLoad(msgs, router, nil, label)
+}
+
+// buildLoad load of msgs, full rows, or partial rows of partialColumns
+func (o *Output) buildLoad(msgs []*core.Msg, router *metas.Router, partialColumns []string, label string) *Load {
+	targetSchema, targetTable := router.TargetSchema, router.TargetTable
+	var content []string
+	switch {
+	case o.conf.Format == FormatCsv && partialColumns != nil:
+		content = o.generateCsv(msgs, partialColumns, false)
+	case o.conf.Format == FormatCsv:
+		content = o.generateCsv(msgs, router.ColumnsMapper.SourceColumns, true)
+	case partialColumns != nil:
+		content = generatePartialJson(msgs, partialColumns)
+	default:
+		content = generateJson(msgs)
+	}
+	for _, s := range content {
+		log.Debugf("%s load %s.%s row data: %v", o.dialect.Name(), targetSchema, targetTable, s)
+	}
+	log.Debugf("%s bulk load %s.%s row data num: %d", o.dialect.Name(), targetSchema, targetTable, len(content))
+	return &Load{
+		// same label on retry, target loads a batch at most once
+		Label:          label,
+		TargetSchema:   targetSchema,
+		TargetTable:    targetTable,
+		ColumnsMapper:  router.ColumnsMapper,
+		Content:        content,
+		PartialColumns: partialColumns,
+	}
+}
+
+// compactMsgs merge changes of a primary key to its final state if configured
+func (o *Output) compactMsgs(msgs []*core.Msg, router *metas.Router) []*core.Msg {
+	if !o.conf.Compact {
+		return msgs
+	}
+	compactedMsgs := core.CompactMsgs(msgs, router.ColumnsMapper.PrimaryKeys)
+	metrics.OpsWriteCompacted.Add(float64(len(msgs) - len(compactedMsgs)))
+	return compactedMsgs
+}
+
+func (o *Output) execute(msgs []*core.Msg, router *metas.Router) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	var loads []*Load
+	if o.conf.PartialUpdate {
+		loads = o.newPartialLoads(msgs, router)
+	} else {
+		loads = []*Load{o.newLoad(msgs, router)}
+	}
+	// loads in order, rows of a key in a later load are newer
+	for _, load := range loads {
+		err := o.retry("send data", func() error {
+			return o.sendData(load)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unknownLoadError load without label whose result is unknown, retry may load it twice
+type unknownLoadError struct {
+	err error
+}
+
+func (e *unknownLoadError) Error() string {
+	return fmt.Sprintf("load result unknown, not retried: %v", e.err)
+}
+
+// retryBackoff wait after failed attempt i, grows with attempts
+var retryBackoff = func(i int) time.Duration {
+	return time.Duration(RetryInterval*(i+1)) * time.Second
+}
+
+func (o *Output) retry(action string, f func() error) error {
+	var err error
+	for i := 0; i < RetryCount; i++ {
+		err = f()
+		var unknownErr *unknownLoadError
+		if errors.As(err, &unknownErr) {
+			break
+		}
+		if err != nil {
+			log.Warnf("%s failed, err: %v, execute retry...", action, err.Error())
+			if i+1 == RetryCount {
+				break
+			}
+			time.Sleep(retryBackoff(i))
+			continue
+		}
+		break
+	}
+	return err
+}
+
+func (o *Output) sendData(load *Load) error {
+	req := o.NewLoadRequest("PUT", fmt.Sprintf("/api/%s/%s/_stream_load", load.TargetSchema, load.TargetTable), load)
+	response, err := o.client.Do(req)
+	if err != nil {
+		if o.conf.GroupCommit != "" {
+			// group commit loads have no label, response lost load may have been done,
+			// not retried here, the batch is loaded again after restart from the last position (at least once)
+			return &unknownLoadError{err: err}
+		}
+		// response lost, load may have been done
+		if loaded, stateErr := o.waitLabelState(load.TargetSchema, load.Label); stateErr == nil && loaded {
+			metrics.OpsWriteProcessed.Add(float64(len(load.Content)))
+			return nil
+		}
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	returnMap, err := parseResponse(response)
+	if err != nil {
+		if o.conf.GroupCommit != "" {
+			return &unknownLoadError{err: err}
+		}
+		return err
+	}
+	loaded, err := o.loadSucceeded(returnMap, load.TargetSchema, load.Label)
+	if err != nil {
+		return err
+	}
+	if !loaded {
+		return LoadError(returnMap, load)
+	}
+	// prom write event number counter
+	numberLoadedRows, ok := returnMap["NumberLoadedRows"].(float64)
+	if !ok { // label already exists
+		numberLoadedRows = float64(len(load.Content))
+	}
+	metrics.OpsWriteProcessed.Add(numberLoadedRows)
+	return nil
+}
+
+// NewRequest target fe request with auth
+func (o *Output) NewRequest(method string, path string, body io.Reader) *http.Request {
+	req, _ := http.NewRequest(method, fmt.Sprintf("http://%s:%d%s", o.conf.Host, o.conf.LoadPort, path), body)
+	req.Header.Add("Authorization", "Basic "+o.auth())
+	return req
+}
+
+// NewLoadRequest request with load content and load headers
+func (o *Output) NewLoadRequest(method string, path string, load *Load) *http.Request {
+	body, err := o.encodeBody(load)
+	if err != nil {
+		log.Fatalf("%s encode load %s body err %v", o.dialect.Name(), load.Label, err)
+	}
+	req := o.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Add("Expect", "100-continue")
+	req.Header.Add("strict_mode", "true")
+	if o.conf.GroupCommit != "" {
+		o.dialect.(GroupCommitDialect).SetGroupCommitHeaders(req, o.conf.GroupCommit)
+	} else {
+		req.Header.Add("label", load.Label)
+	}
+	if o.conf.Format == FormatJson {
+		req.Header.Add("format", "json")
+		req.Header.Add("strip_outer_array", "true")
+	}
+	o.dialect.SetFormatHeaders(req, o.conf)
+	if load.PartialColumns != nil {
+		o.dialect.(PartialDialect).SetPartialHeaders(req, load.PartialColumns)
+	} else {
+		o.dialect.SetHeaders(req, load.ColumnsMapper)
+	}
+	return req
+}
+
+// Send request and parse json response
+func (o *Output) Send(req *http.Request) (map[string]interface{}, error) {
+	response, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	return parseResponse(response)
+}
+
+func LoadError(returnMap map[string]interface{}, load *Load) error {
+	message := returnMap["Message"]
+	if message == nil {
+		message = returnMap["msg"]
+	}
+	errorUrl := returnMap["ErrorURL"]
+	errorMsg := fmt.Sprintf("%v", message) +
+		fmt.Sprintf(", targetTable: %s.%s", load.TargetSchema, load.TargetTable) +
+		fmt.Sprintf(", visit ErrorURL to view error details, ErrorURL: %v", errorUrl)
+	return errors.New(errorMsg)
+}
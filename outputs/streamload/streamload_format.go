@@ -0,0 +1,233 @@
+package streamload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/pierrec/lz4/v4"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatJson = "json"
+	FormatCsv  = "csv"
+
+	CompressGzip = "gzip"
+	CompressLz4  = "lz4"
+
+	DefaultColumnSeparator = "\t"
+	DefaultRowDelimiter    = "\n"
+
+	CsvNull    = `\N`
+	CsvEnclose = `"`
+	CsvEscape  = `\`
+)
+
+var hexSeparator = regexp.MustCompile(`^(\\x[0-9a-fA-F]{2})+$`)
+
+// initFormat check format and compress options, csv separators may be given as \x01 hex
+func (c *Config) initFormat() error {
+	switch c.Format {
+	case "":
+		c.Format = FormatJson
+	case FormatJson, FormatCsv:
+	default:
+		return errors.Errorf("unknown format: %s, support %s, %s", c.Format, FormatJson, FormatCsv)
+	}
+	switch c.Compress {
+	case "", CompressGzip, CompressLz4:
+	default:
+		return errors.Errorf("unknown compress: %s, support %s, %s", c.Compress, CompressGzip, CompressLz4)
+	}
+	var err error
+	if c.ColumnSeparator, err = parseSeparator(c.ColumnSeparator, DefaultColumnSeparator); err != nil {
+		return err
+	}
+	if c.RowDelimiter, err = parseSeparator(c.RowDelimiter, DefaultRowDelimiter); err != nil {
+		return err
+	}
+	if c.ColumnSeparator == c.RowDelimiter {
+		return errors.Errorf("column-separator and row-delimiter can not be the same")
+	}
+	for _, s := range []string{c.ColumnSeparator, c.RowDelimiter} {
+		if strings.Contains(s, CsvEnclose) || strings.Contains(s, CsvEscape) {
+			return errors.Errorf("csv separator can not contain %s or %s", CsvEnclose, CsvEscape)
+		}
+	}
+	return nil
+}
+
+func parseSeparator(s string, defaultSeparator string) (string, error) {
+	if s == "" {
+		return defaultSeparator, nil
+	}
+	if hexSeparator.MatchString(s) {
+		b, err := hex.DecodeString(strings.ReplaceAll(s, `\x`, ""))
+		return string(b), err
+	}
+	return s, nil
+}
+
+// HeaderSeparator separator in \x hex form, whitespace separators survive http headers
+func HeaderSeparator(s string) string {
+	return `\x` + hex.EncodeToString([]byte(s))
+}
+
+// encodeBody load content joined by format, compressed if configured
+func (o *Output) encodeBody(load *Load) ([]byte, error) {
+	var body []byte
+	if o.conf.Format == FormatCsv {
+		body = []byte(strings.Join(load.Content, o.conf.RowDelimiter))
+	} else {
+		body = []byte(`[` + strings.Join(load.Content, ",") + `]`)
+	}
+	switch o.conf.Compress {
+	case CompressGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressLz4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return body, nil
+}
+
+// generateCsv csv rows of columns, full rows end with delete column, partial rows do not
+func (o *Output) generateCsv(msgs []*core.Msg, columns []string, withDeleteColumn bool) []string {
+	csvList := make([]string, 0, len(msgs))
+	tableColumns := make(map[string]map[string]metas.Column)
+	for _, event := range msgs {
+		columnTypes := o.columnTypes(tableColumns, event)
+		values := make([]string, 0, len(columns)+1)
+		for _, column := range columns {
+			values = append(values, o.csvValue(event.DmlMsg.Data[column], columnTypes[column]))
+		}
+		if withDeleteColumn {
+			switch event.DmlMsg.Action {
+			case core.InsertAction, core.UpdateAction, core.ReplaceAction:
+				values = append(values, "0")
+			case core.DeleteAction:
+				values = append(values, "1")
+			default:
+				log.Fatalf("unhandled message type: %v", event)
+			}
+		}
+		csvList = append(csvList, strings.Join(values, o.conf.ColumnSeparator))
+	}
+	return csvList
+}
+
+// columnTypes source table columns of msg table version, empty if meta not found, values are formatted by go type
+func (o *Output) columnTypes(tableColumns map[string]map[string]metas.Column, event *core.Msg) map[string]metas.Column {
+	key := fmt.Sprintf("%s.%s.%d", event.Database, event.Table, event.DmlMsg.TableVersion)
+	if columnTypes, ok := tableColumns[key]; ok {
+		return columnTypes
+	}
+	columnTypes := make(map[string]metas.Column)
+	if o.metas != nil && o.metas.Input != nil {
+		table, err := o.metas.Input.GetVersion(event.Database, event.Table, event.DmlMsg.TableVersion)
+		if err == nil && table != nil {
+			for _, column := range table.Columns {
+				columnTypes[column.Name] = column
+			}
+		}
+	}
+	tableColumns[key] = columnTypes
+	return columnTypes
+}
+
+// csvValue \N for null, values with separators, enclose or escape chars are enclosed and escaped
+func (o *Output) csvValue(value interface{}, column metas.Column) string {
+	s, isNull := formatValue(value, column)
+	if isNull {
+		return CsvNull
+	}
+	if s == CsvNull || strings.Contains(s, CsvEnclose) || strings.Contains(s, CsvEscape) ||
+		strings.Contains(s, o.conf.ColumnSeparator) || strings.Contains(s, o.conf.RowDelimiter) {
+		s = strings.ReplaceAll(s, CsvEscape, CsvEscape+CsvEscape)
+		s = strings.ReplaceAll(s, CsvEnclose, CsvEscape+CsvEnclose)
+		return CsvEnclose + s + CsvEnclose
+	}
+	return s
+}
+
+// formatValue text of a value by source column type, zero dates are null
+func formatValue(value interface{}, column metas.Column) (string, bool) {
+	if value == nil {
+		return "", true
+	}
+	switch column.Type {
+	case metas.TypeDatetime, metas.TypeTimestamp, metas.TypeDate:
+		switch v := value.(type) {
+		case time.Time:
+			if v.IsZero() {
+				return "", true
+			}
+			if column.Type == metas.TypeDate {
+				return v.Format(time.DateOnly), false
+			}
+			return v.Format("2006-01-02 15:04:05.999999"), false
+		case string:
+			if strings.HasPrefix(v, "0000-00-00") {
+				return "", true
+			}
+			return v, false
+		}
+	case metas.TypeBit:
+		switch v := value.(type) {
+		case []byte:
+			return new(big.Int).SetBytes(v).String(), false
+		case int64:
+			return strconv.FormatUint(uint64(v), 10), false
+		}
+	case metas.TypeBinary:
+		switch v := value.(type) {
+		case []byte:
+			return string(v), false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, false
+	case []byte:
+		return string(v), false
+	case float64:
+		// no exponent, decimal columns reject 1e+20
+		return strconv.FormatFloat(v, 'f', -1, 64), false
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), false
+	case bool:
+		if v {
+			return "1", false
+		}
+		return "0", false
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999"), false
+	case fmt.Stringer: // decimal.Decimal
+		return v.String(), false
+	}
+	return fmt.Sprintf("%v", value), false
+}
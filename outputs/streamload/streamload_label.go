@@ -0,0 +1,137 @@
+package streamload
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MaxLabelLength         = 128
+	LabelStatePollCount    = 10
+	LabelStatePollInterval = time.Second
+
+	statusSuccess        = "Success"
+	statusPublishTimeout = "Publish Timeout" // committed, visible after publish
+	statusLabelExists    = "Label Already Exists"
+	jobStatusFinished    = "FINISHED"
+	jobStatusRunning     = "RUNNING"
+)
+
+var labelInvalidChar = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// generateLabel deterministic label of a batch, pipeline name, router and gtid range of the batch,
+// batches hold complete source transactions, so the same gtid range of a table is always the same rows.
+// loadId numbers the parts of a source transaction over batch size, 0 for a whole transaction,
+// part numbers the loads of a batch split by partial update columns, 0 for a single load
+func generateLabel(name string, targetSchema string, targetTable string, msgs []*core.Msg, loadId int, part int) string {
+	gtids := gtidRange(msgs)
+	if gtids == "" {
+		// no gtid, unique label, a retried load may be loaded again
+		gtids = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	suffix := "_" + gtids
+	if loadId > 0 {
+		suffix += fmt.Sprintf("_load%d", loadId)
+	}
+	if part > 0 {
+		suffix += fmt.Sprintf("_%d", part)
+	}
+	suffix = labelInvalidChar.ReplaceAllString(suffix, "_")
+	prefix := labelInvalidChar.ReplaceAllString(strings.Join([]string{name, targetSchema, targetTable}, "_"), "_")
+	// gtid range identifies the batch, cut the prefix
+	if len(prefix)+len(suffix) > MaxLabelLength {
+		prefix = prefix[:max(MaxLabelLength-len(suffix), 0)]
+	}
+	label := prefix + suffix
+	if len(label) > MaxLabelLength {
+		label = label[len(label)-MaxLabelLength:]
+	}
+	return label
+}
+
+// gtidRange first and last source transaction gtid of msgs, uuid:first-last if same server uuid
+func gtidRange(msgs []*core.Msg) string {
+	first, last := msgs[0].InputContext.Gtid, msgs[len(msgs)-1].InputContext.Gtid
+	if first == "" || first == last {
+		return first
+	}
+	firstSid, firstGno, ok1 := strings.Cut(first, ":")
+	lastSid, lastGno, ok2 := strings.Cut(last, ":")
+	if ok1 && ok2 && firstSid == lastSid {
+		return fmt.Sprintf("%s:%s-%s", firstSid, firstGno, lastGno)
+	}
+	return first + "-" + last
+}
+
+// loadSucceeded load response status, label already exists is success if the existing job finished,
+// a running existing job is waited for
+func (o *Output) loadSucceeded(returnMap map[string]interface{}, targetSchema string, label string) (bool, error) {
+	switch returnMap["Status"] {
+	case statusSuccess, statusPublishTimeout:
+		return true, nil
+	case statusLabelExists:
+		existingJobStatus := fmt.Sprintf("%v", returnMap["ExistingJobStatus"])
+		log.Infof("%s load label %s already exists, existing job status: %s", o.dialect.Name(), label, existingJobStatus)
+		switch existingJobStatus {
+		case jobStatusFinished:
+			return true, nil
+		case jobStatusRunning:
+			return o.waitLabelState(targetSchema, label)
+		}
+	}
+	return false, nil
+}
+
+// waitLabelState poll label state until load finished or aborted, used when load response is lost
+func (o *Output) waitLabelState(targetSchema string, label string) (bool, error) {
+	var err error
+	for i := 0; i < LabelStatePollCount; i++ {
+		var state string
+		state, err = o.getLabelState(targetSchema, label)
+		if err == nil {
+			log.Infof("%s load label %s state: %s", o.dialect.Name(), label, state)
+			switch {
+			case isCommittedState(state):
+				return true, nil
+			case state == "ABORTED" || state == "UNKNOWN": // not loaded, safe to load again with the same label
+				return false, nil
+			}
+		}
+		time.Sleep(LabelStatePollInterval)
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, errors.Errorf("%s load label %s state poll timeout", o.dialect.Name(), label)
+}
+
+func (o *Output) labelCommitted(targetSchema string, label string) bool {
+	state, err := o.getLabelState(targetSchema, label)
+	return err == nil && isCommittedState(state)
+}
+
+func isCommittedState(state string) bool {
+	return state == "VISIBLE" || state == "COMMITTED" || state == jobStatusFinished
+}
+
+// getLabelState doris returns state in data, starrocks in state
+func (o *Output) getLabelState(targetSchema string, label string) (string, error) {
+	req := o.NewRequest("GET", fmt.Sprintf("/api/%s/get_load_state?label=%s", targetSchema, url.QueryEscape(label)), nil)
+	returnMap, err := o.Send(req)
+	if err != nil {
+		return "", err
+	}
+	if state, ok := returnMap["state"].(string); ok {
+		return state, nil
+	}
+	if state, ok := returnMap["data"].(string); ok {
+		return state, nil
+	}
+	return "", errors.Errorf("get label %s state failed, response: %v", label, returnMap)
+}
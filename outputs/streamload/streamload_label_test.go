@@ -0,0 +1,50 @@
+package streamload
+
+import (
+	"github.com/sqlpub/qin-cdc/core"
+	"strings"
+	"testing"
+)
+
+func testGtidMsgs(gtids ...string) []*core.Msg {
+	msgs := make([]*core.Msg, 0, len(gtids))
+	for _, gtid := range gtids {
+		msg := &core.Msg{Type: core.MsgDML, DmlMsg: &core.DMLMsg{Action: core.InsertAction}}
+		msg.InputContext.Gtid = gtid
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestGenerateLabel(t *testing.T) {
+	const sid = "3ba13781-44eb-2157-88a5-0dc879ec2221"
+	tests := []struct {
+		msgs   []*core.Msg
+		loadId int
+		part   int
+		label  string
+	}{
+		{testGtidMsgs(sid + ":5"), 0, 0, "p1_db_t_" + sid + "_5"},
+		{testGtidMsgs(sid+":5", sid+":5", sid+":9"), 0, 0, "p1_db_t_" + sid + "_5-9"},
+		{testGtidMsgs(sid+":5", sid+":9"), 0, 2, "p1_db_t_" + sid + "_5-9_2"},
+		{testGtidMsgs(sid+":5", sid+":5"), 3, 0, "p1_db_t_" + sid + "_5_load3"},
+		{testGtidMsgs(sid + ":5"), 3, 2, "p1_db_t_" + sid + "_5_load3_2"},
+	}
+	for _, tt := range tests {
+		if label := generateLabel("p1", "db", "t", tt.msgs, tt.loadId, tt.part); label != tt.label {
+			t.Errorf("label = %s, want %s", label, tt.label)
+		}
+	}
+	// label depends only on pipeline, router and gtid range, not on row content
+	a := testGtidMsgs(sid+":1", sid+":3")
+	b := testGtidMsgs(sid+":1", sid+":2", sid+":3")
+	b[1].DmlMsg.Data = map[string]interface{}{"id": 1}
+	if generateLabel("p1", "db", "t", a, 0, 0) != generateLabel("p1", "db", "t", b, 0, 0) {
+		t.Errorf("same gtid range, different labels")
+	}
+	// gtid range is kept when the label is too long
+	long := generateLabel(strings.Repeat("n", 200), "db", "t", testGtidMsgs(sid+":1", "4ba13781-44eb-2157-88a5-0dc879ec2221:7"), 0, 3)
+	if len(long) != MaxLabelLength || !strings.HasSuffix(long, "_1-4ba13781-44eb-2157-88a5-0dc879ec2221_7_3") {
+		t.Errorf("long label = %s", long)
+	}
+}
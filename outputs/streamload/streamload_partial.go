@@ -0,0 +1,104 @@
+package streamload
+
+import (
+	"github.com/goccy/go-json"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// partialGroup rows with the same changed columns, nil columns for full rows
+type partialGroup struct {
+	columns []string
+	msgs    []*core.Msg
+}
+
+// newPartialLoads updates with old row image load only primary keys and changed columns,
+// rows with the same changed columns go to one load
+func (o *Output) newPartialLoads(msgs []*core.Msg, router *metas.Router) []*Load {
+	batchMsgs := msgs
+	// primary key changed update, delete old key row before upsert new key row
+	msgs = core.SplitPrimaryKeyChange(msgs, router.ColumnsMapper.PrimaryKeys)
+	msgs = o.compactMsgs(msgs, router)
+	groups := groupByChangedColumns(msgs, router.ColumnsMapper)
+	loads := make([]*Load, 0, len(groups))
+	for i, group := range groups {
+		// groups of the same batch are numbered in order
+		label := generateLabel(o.conf.Name, router.TargetSchema, router.TargetTable, batchMsgs, o.txnLoadId, i+1)
+		loads = append(loads, o.buildLoad(group.msgs, router, group.columns, label))
+	}
+	return loads
+}
+
+// groupByChangedColumns groups keep msgs order of a row, a row already in another group of the segment
+// starts a new segment, groups of a segment can be loaded in any order
+func groupByChangedColumns(msgs []*core.Msg, columnsMapper metas.ColumnsMapper) []*partialGroup {
+	var groups []*partialGroup
+	var columnsGroups, rowGroups map[string]*partialGroup
+	newSegment := func() {
+		columnsGroups = make(map[string]*partialGroup)
+		rowGroups = make(map[string]*partialGroup)
+	}
+	newSegment()
+	for _, msg := range msgs {
+		columns := changedColumns(msg.DmlMsg, columnsMapper)
+		columnsKey := strings.Join(columns, ",") // empty for full rows
+		rowKey := generateRowKey(msg.DmlMsg, columnsMapper.PrimaryKeys)
+		group := columnsGroups[columnsKey]
+		if rowGroup, ok := rowGroups[rowKey]; ok && rowGroup != group {
+			newSegment()
+			group = nil
+		}
+		if group == nil {
+			group = &partialGroup{columns: columns}
+			columnsGroups[columnsKey] = group
+			groups = append(groups, group)
+		}
+		group.msgs = append(group.msgs, msg)
+		rowGroups[rowKey] = group
+	}
+	return groups
+}
+
+// changedColumns primary keys and columns changed by an update, nil if full row needed
+func changedColumns(dmlMsg *core.DMLMsg, columnsMapper metas.ColumnsMapper) []string {
+	if dmlMsg.Action != core.UpdateAction || dmlMsg.Old == nil || len(columnsMapper.PrimaryKeys) == 0 {
+		return nil
+	}
+	var columns []string
+	for _, column := range columnsMapper.SourceColumns {
+		oldValue, ok := dmlMsg.Old[column]
+		if slices.Contains(columnsMapper.PrimaryKeys, column) || !ok || !reflect.DeepEqual(oldValue, dmlMsg.Data[column]) {
+			columns = append(columns, column)
+		}
+	}
+	if len(columns) == len(columnsMapper.SourceColumns) {
+		return nil
+	}
+	return columns
+}
+
+func generateRowKey(dmlMsg *core.DMLMsg, pks []string) string {
+	values := make([]interface{}, 0, len(pks))
+	for _, pk := range pks {
+		values = append(values, dmlMsg.Data[pk])
+	}
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// generatePartialJson rows of columns only, partial loads are upserts without delete column
+func generatePartialJson(msgs []*core.Msg, columns []string) []string {
+	jsonList := make([]string, 0, len(msgs))
+	for _, event := range msgs {
+		row := make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			row[column] = event.DmlMsg.Data[column]
+		}
+		b, _ := json.Marshal(row)
+		jsonList = append(jsonList, string(b))
+	}
+	return jsonList
+}
@@ -0,0 +1,86 @@
+package streamload
+
+import (
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/utils"
+	"time"
+)
+
+const (
+	GroupCommitAsync = "async"
+	GroupCommitSync  = "sync"
+
+	DefaultMaxConcurrentLoads = 1
+	latencyWeight             = 0.3 // ewma weight of the latest flush latency
+)
+
+// checkGroupCommit group commit loads have no label, no transaction and full rows only
+func (c *Config) checkGroupCommit(dialect Dialect) error {
+	switch c.GroupCommit {
+	case "":
+		return nil
+	case GroupCommitAsync, GroupCommitSync:
+	default:
+		return errors.Errorf("unknown group commit mode: %s, support %s, %s", c.GroupCommit, GroupCommitAsync, GroupCommitSync)
+	}
+	if _, ok := dialect.(GroupCommitDialect); !ok {
+		return errors.Errorf("group commit is not supported")
+	}
+	if c.TwoPhaseCommit || c.PartialUpdate {
+		return errors.Errorf("group commit can not be used with two phase commit or partial update")
+	}
+	return nil
+}
+
+// scheduler limits concurrent loads of all routers, adapts flush interval to load latency:
+// slow loads grow the interval to batch more rows per load, fast loads shrink it back to the batch interval
+type scheduler struct {
+	maxConcurrentLoads int
+	minInterval        time.Duration
+	maxInterval        time.Duration
+	interval           time.Duration
+	latency            time.Duration // ewma of flush latency
+}
+
+func newScheduler(maxConcurrentLoads int, batchIntervalMs int, maxBatchIntervalMs int) *scheduler {
+	if maxConcurrentLoads <= 0 {
+		maxConcurrentLoads = DefaultMaxConcurrentLoads
+	}
+	if maxBatchIntervalMs < batchIntervalMs {
+		maxBatchIntervalMs = batchIntervalMs
+	}
+	return &scheduler{
+		maxConcurrentLoads: maxConcurrentLoads,
+		minInterval:        time.Duration(batchIntervalMs) * time.Millisecond,
+		maxInterval:        time.Duration(maxBatchIntervalMs) * time.Millisecond,
+		interval:           time.Duration(batchIntervalMs) * time.Millisecond,
+	}
+}
+
+// run table loads at most max concurrent loads at a time, loads of a table run in order in one task,
+// wait for all, errors of all failed tables are returned
+func (s *scheduler) run(tasks []func() error) error {
+	return utils.RunTasks(s.maxConcurrentLoads, tasks)
+}
+
+// observe flush latency, interval doubles while loads take over half of it, shrinks while under a tenth
+func (s *scheduler) observe(latency time.Duration) time.Duration {
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(s.latency))
+	}
+	interval := s.interval
+	switch {
+	case s.latency > interval/2:
+		interval = min(interval*2, s.maxInterval)
+	case s.latency < interval/10:
+		interval = max(interval*3/4, s.minInterval)
+	}
+	if interval != s.interval {
+		log.Infof("load latency %v, flush interval %v -> %v", s.latency, s.interval, interval)
+		s.interval = interval
+	}
+	return s.interval
+}
@@ -0,0 +1,363 @@
+package streamload
+
+import (
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metas"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDialect records nothing target specific, group commit by header
+type testDialect struct{}
+
+func (d *testDialect) Name() string { return "test" }
+func (d *testDialect) SetHeaders(req *http.Request, columnsMapper metas.ColumnsMapper) {
+	req.Header.Add("columns", strings.Join(columnsMapper.SourceColumns, ","))
+}
+func (d *testDialect) SetFormatHeaders(*http.Request, *Config) {}
+func (d *testDialect) SetGroupCommitHeaders(req *http.Request, mode string) {
+	req.Header.Add("group_commit", mode)
+}
+
+// testTarget fe stand-in, load responses are served in order, the last one repeats
+type testTarget struct {
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter, r *http.Request)
+	loads     []*http.Request
+	bodies    []string
+	states    []string // get_load_state labels
+	state     string
+}
+
+func newTestTarget(t *testing.T, responses ...func(w http.ResponseWriter, r *http.Request)) (*testTarget, *httptest.Server) {
+	target := &testTarget{responses: responses, state: "VISIBLE"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target.mu.Lock()
+		if strings.HasSuffix(r.URL.Path, "/get_load_state") {
+			target.states = append(target.states, r.URL.Query().Get("label"))
+			state := target.state
+			target.mu.Unlock()
+			_, _ = w.Write([]byte(`{"status":"OK","data":"` + state + `"}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		target.loads = append(target.loads, r)
+		target.bodies = append(target.bodies, string(body))
+		respond := target.responses[min(len(target.loads), len(target.responses))-1]
+		target.mu.Unlock()
+		respond(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return target, server
+}
+
+// requests load requests, bodies and label state queries received so far
+func (target *testTarget) requests() ([]*http.Request, []string, []string) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	return slices.Clone(target.loads), slices.Clone(target.bodies), slices.Clone(target.states)
+}
+
+func respondJson(body string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+// respondLost close connection without response, load result unknown to the client
+func respondLost(w http.ResponseWriter, _ *http.Request) {
+	conn, _, _ := w.(http.Hijacker).Hijack()
+	_ = conn.Close()
+}
+
+func newTestOutput(t *testing.T, server *httptest.Server, conf *Config) *Output {
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	conf.Host = host
+	conf.LoadPort, _ = strconv.Atoi(port)
+	conf.UserName, conf.Password = "root", "pw"
+	conf.Name = "p1"
+	return NewOutput(&testDialect{}, conf, &core.Metas{})
+}
+
+func noBackoff(t *testing.T) *[]time.Duration {
+	var backoffs []time.Duration
+	origin := retryBackoff
+	retryBackoff = func(i int) time.Duration {
+		backoffs = append(backoffs, origin(i))
+		return 0
+	}
+	t.Cleanup(func() { retryBackoff = origin })
+	return &backoffs
+}
+
+func testLoadMsgs() ([]*core.Msg, *metas.Router) {
+	router := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t"}
+	router.ColumnsMapper.SourceColumns = []string{"id", "v"}
+	router.ColumnsMapper.PrimaryKeys = []string{"id"}
+	msg := &core.Msg{Database: "db", Table: "t", Type: core.MsgDML, DmlMsg: &core.DMLMsg{
+		Action: core.InsertAction, Data: map[string]interface{}{"id": 1, "v": "a"}}}
+	msg.InputContext.Gtid = "sid:3"
+	return []*core.Msg{msg}, router
+}
+
+// TestNewLoadRequest headers of the engine, target specific headers are of the dialect
+func TestNewLoadRequest(t *testing.T) {
+	load := &Load{Label: "p1_db_t_sid_3", TargetSchema: "db", TargetTable: "t",
+		ColumnsMapper: metas.ColumnsMapper{SourceColumns: []string{"id", "v"}},
+		Content:       []string{`{"id":1,"v":"a"}`, `{"id":2,"v":"b"}`}}
+	tests := []struct {
+		conf *Config
+		body string
+		want http.Header
+	}{
+		{&Config{}, `[{"id":1,"v":"a"},{"id":2,"v":"b"}]`, http.Header{
+			"Authorization": {"Basic cm9vdDpwdw=="}, "Expect": {"100-continue"}, "Strict_mode": {"true"},
+			"Label": {"p1_db_t_sid_3"}, "Format": {"json"}, "Strip_outer_array": {"true"}, "Columns": {"id,v"}}},
+		{&Config{Format: FormatCsv}, `{"id":1,"v":"a"}` + "\n" + `{"id":2,"v":"b"}`, http.Header{
+			"Authorization": {"Basic cm9vdDpwdw=="}, "Expect": {"100-continue"}, "Strict_mode": {"true"},
+			"Label": {"p1_db_t_sid_3"}, "Columns": {"id,v"}}},
+		{&Config{GroupCommit: GroupCommitSync}, `[{"id":1,"v":"a"},{"id":2,"v":"b"}]`, http.Header{
+			"Authorization": {"Basic cm9vdDpwdw=="}, "Expect": {"100-continue"}, "Strict_mode": {"true"},
+			"Group_commit": {"sync"}, "Format": {"json"}, "Strip_outer_array": {"true"}, "Columns": {"id,v"}}},
+	}
+	for _, tt := range tests {
+		tt.conf.Host, tt.conf.LoadPort, tt.conf.UserName, tt.conf.Password = "fe", 8030, "root", "pw"
+		req := NewOutput(&testDialect{}, tt.conf, &core.Metas{}).NewLoadRequest("PUT", "/api/db/t/_stream_load", load)
+		body, _ := io.ReadAll(req.Body)
+		if req.Method != "PUT" || req.URL.String() != "http://fe:8030/api/db/t/_stream_load" {
+			t.Errorf("%+v: request = %s %s", tt.conf, req.Method, req.URL)
+		}
+		if string(body) != tt.body {
+			t.Errorf("%+v: body = %s, want %s", tt.conf, body, tt.body)
+		}
+		if !reflect.DeepEqual(req.Header, tt.want) {
+			t.Errorf("%+v: headers = %v, want %v", tt.conf, req.Header, tt.want)
+		}
+	}
+}
+
+func TestExecuteRetryBackoff(t *testing.T) {
+	backoffs := noBackoff(t)
+	target, server := newTestTarget(t,
+		respondJson(`{"Status":"Fail","Message":"too many versions"}`),
+		respondJson(`{"Status":"Fail","Message":"too many versions"}`),
+		respondJson(`{"Status":"Success","NumberLoadedRows":1}`))
+	o := newTestOutput(t, server, &Config{})
+	msgs, router := testLoadMsgs()
+	if err := o.execute(msgs, router); err != nil {
+		t.Fatal(err)
+	}
+	loads, _, _ := target.requests()
+	if len(loads) != 3 {
+		t.Fatalf("loads = %d, want 3", len(loads))
+	}
+	// a retried load keeps its label, the target loads it at most once
+	for _, r := range loads {
+		if label := r.Header.Get("label"); label != "p1_db_t_sid_3" {
+			t.Errorf("label = %s", label)
+		}
+	}
+	if len(*backoffs) != 2 || (*backoffs)[0] != 5*time.Second || (*backoffs)[1] != 10*time.Second {
+		t.Errorf("backoffs = %v", *backoffs)
+	}
+
+	// fails after retry count attempts
+	target, server = newTestTarget(t, respondJson(`{"Status":"Fail","Message":"bad row","ErrorURL":"http://be/err"}`))
+	o = newTestOutput(t, server, &Config{})
+	err := o.execute(msgs, router)
+	if err == nil || !strings.Contains(err.Error(), "bad row") || !strings.Contains(err.Error(), "http://be/err") {
+		t.Errorf("err = %v", err)
+	}
+	if loads, _, _ = target.requests(); len(loads) != RetryCount {
+		t.Errorf("loads = %d, want %d", len(loads), RetryCount)
+	}
+}
+
+func TestExecuteLabelAlreadyExists(t *testing.T) {
+	noBackoff(t)
+	msgs, router := testLoadMsgs()
+	// finished job of the label, batch was loaded before a restart
+	target, server := newTestTarget(t, respondJson(`{"Status":"Label Already Exists","ExistingJobStatus":"FINISHED"}`))
+	if err := newTestOutput(t, server, &Config{}).execute(msgs, router); err != nil {
+		t.Fatal(err)
+	}
+	if loads, _, states := target.requests(); len(loads) != 1 || len(states) != 0 {
+		t.Errorf("loads = %d, state queries = %d", len(loads), len(states))
+	}
+	// running job of the label is waited for
+	target, server = newTestTarget(t, respondJson(`{"Status":"Label Already Exists","ExistingJobStatus":"RUNNING"}`))
+	if err := newTestOutput(t, server, &Config{}).execute(msgs, router); err != nil {
+		t.Fatal(err)
+	}
+	if loads, _, states := target.requests(); len(loads) != 1 || len(states) != 1 || states[0] != "p1_db_t_sid_3" {
+		t.Errorf("loads = %d, state queries = %v", len(loads), states)
+	}
+}
+
+func TestExecuteResponseLost(t *testing.T) {
+	noBackoff(t)
+	msgs, router := testLoadMsgs()
+	// label state tells the lost load was done, not loaded again
+	target, server := newTestTarget(t, respondLost)
+	if err := newTestOutput(t, server, &Config{}).execute(msgs, router); err != nil {
+		t.Fatal(err)
+	}
+	if loads, _, states := target.requests(); len(loads) != 1 || len(states) != 1 {
+		t.Errorf("loads = %d, state queries = %d", len(loads), len(states))
+	}
+	// aborted label is loaded again with the same label
+	target, server = newTestTarget(t, respondLost, respondJson(`{"Status":"Success","NumberLoadedRows":1}`))
+	target.mu.Lock()
+	target.state = "ABORTED"
+	target.mu.Unlock()
+	if err := newTestOutput(t, server, &Config{}).execute(msgs, router); err != nil {
+		t.Fatal(err)
+	}
+	if loads, _, _ := target.requests(); len(loads) != 2 || loads[1].Header.Get("label") != loads[0].Header.Get("label") {
+		t.Errorf("loads = %d", len(loads))
+	}
+	// group commit load has no label, not retried
+	target, server = newTestTarget(t, respondLost)
+	err := newTestOutput(t, server, &Config{GroupCommit: GroupCommitAsync}).execute(msgs, router)
+	loads, _, _ := target.requests()
+	if err == nil || len(loads) != 1 {
+		t.Fatalf("group commit lost response: err = %v, loads = %d", err, len(loads))
+	}
+	if loads[0].Header.Get("label") != "" || loads[0].Header.Get("group_commit") != GroupCommitAsync {
+		t.Errorf("group commit headers = %v", loads[0].Header)
+	}
+	// group commit failure response is retried
+	target, server = newTestTarget(t, respondJson(`{"Status":"Fail","Message":"x"}`), respondJson(`{"Status":"Success"}`))
+	err = newTestOutput(t, server, &Config{GroupCommit: GroupCommitSync}).execute(msgs, router)
+	if loads, _, _ = target.requests(); err != nil || len(loads) != 2 {
+		t.Errorf("group commit fail response: err = %v, loads = %d", err, len(loads))
+	}
+}
+
+func TestRedirectKeepsAuth(t *testing.T) {
+	noBackoff(t)
+	be, beServer := newTestTarget(t, respondJson(`{"Status":"Success","NumberLoadedRows":1}`))
+	_, feServer := newTestTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		// other host name, the http client drops authorization on redirect
+		location := strings.Replace(beServer.URL, "127.0.0.1", "localhost", 1) + r.URL.Path
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	})
+	msgs, router := testLoadMsgs()
+	if err := newTestOutput(t, feServer, &Config{}).execute(msgs, router); err != nil {
+		t.Fatal(err)
+	}
+	loads, bodies, _ := be.requests()
+	if len(loads) != 1 {
+		t.Fatalf("be loads = %d", len(loads))
+	}
+	if auth := loads[0].Header.Values("Authorization"); len(auth) != 1 || auth[0] != "Basic cm9vdDpwdw==" {
+		t.Errorf("be authorization = %v", auth)
+	}
+	if loads[0].Header.Get("label") != "p1_db_t_sid_3" || bodies[0] != `[{"_delete_sign_":0,"id":1,"v":"a"}]` {
+		t.Errorf("be label = %s, body = %s", loads[0].Header.Get("label"), bodies[0])
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	response := &http.Response{Body: io.NopCloser(strings.NewReader(`{"Status":"Success","NumberLoadedRows":2,"TxnId":7}`))}
+	returnMap, err := parseResponse(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if returnMap["Status"] != statusSuccess || returnMap["NumberLoadedRows"] != float64(2) || returnMap["TxnId"] != float64(7) {
+		t.Errorf("response = %v", returnMap)
+	}
+	response = &http.Response{Body: io.NopCloser(strings.NewReader(`<html>502 Bad Gateway</html>`))}
+	if _, err = parseResponse(response); err == nil {
+		t.Errorf("html response: expected error")
+	}
+}
+
+// testPosition records position updates
+type testPosition struct {
+	mu      sync.Mutex
+	updates []string
+}
+
+func (p *testPosition) LoadPosition(string) string { return "" }
+func (p *testPosition) Start()                     {}
+func (p *testPosition) Save() error                { return nil }
+func (p *testPosition) Get() string                { return "" }
+func (p *testPosition) Close()                     {}
+func (p *testPosition) Update(v string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updates = append(p.updates, v)
+	return nil
+}
+
+func (p *testPosition) last() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.updates) == 0 {
+		return ""
+	}
+	return p.updates[len(p.updates)-1]
+}
+
+func TestStartLargeSourceTxn(t *testing.T) {
+	target, server := newTestTarget(t, respondJson(`{"Status":"Success"}`))
+	o := newTestOutput(t, server, &Config{BatchSize: 2, BatchIntervalMs: 60000})
+	_, router := testLoadMsgs()
+	o.metas.Routers = &metas.Routers{Maps: map[string]*metas.Router{metas.GenerateMapRouterKey("db", "t"): router}}
+	pos := &testPosition{}
+	out := make(chan *core.Msg)
+	o.Start(out, pos)
+	t.Cleanup(func() { close(o.Done) })
+
+	send := func(gtid string, ids ...int) {
+		for _, id := range ids {
+			msg := &core.Msg{Database: "db", Table: "t", Type: core.MsgDML, DmlMsg: &core.DMLMsg{
+				Action: core.InsertAction, Data: map[string]interface{}{"id": id, "v": "a"}}}
+			msg.InputContext.Gtid = gtid
+			out <- msg
+		}
+		ctl := &core.Msg{Type: core.MsgCtl}
+		ctl.InputContext.Pos = gtid
+		out <- ctl
+	}
+	send("sid:1", 1)
+	// over batch size, loaded in parts
+	send("sid:2", 2, 3, 4)
+	deadline := time.Now().Add(5 * time.Second)
+	for pos.last() != "sid:2" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	loads, bodies, _ := target.requests()
+	want := []struct{ label, body string }{
+		{"p1_db_t_sid_1", `[{"_delete_sign_":0,"id":1,"v":"a"}]`},
+		{"p1_db_t_sid_2_load1", `[{"_delete_sign_":0,"id":2,"v":"a"},{"_delete_sign_":0,"id":3,"v":"a"}]`},
+		{"p1_db_t_sid_2_load2", `[{"_delete_sign_":0,"id":4,"v":"a"}]`},
+	}
+	if len(loads) != len(want) {
+		t.Fatalf("loads = %d, want %d", len(loads), len(want))
+	}
+	for i, w := range want {
+		if loads[i].Header.Get("label") != w.label || bodies[i] != w.body {
+			t.Errorf("load %d: label = %s, body = %s", i, loads[i].Header.Get("label"), bodies[i])
+		}
+	}
+	// position of the large transaction advanced only after its last part
+	pos.mu.Lock()
+	defer pos.mu.Unlock()
+	if !slices.Equal(pos.updates, []string{"sid:1", "sid:1", "sid:2"}) {
+		t.Errorf("position updates = %v", pos.updates)
+	}
+}
@@ -0,0 +1,61 @@
+package streamload
+
+import (
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/metrics"
+)
+
+// executeTxn prepare loads of all tables, commit them after all prepared, abort all if any fails
+func (o *Output) executeTxn(tableMsgMap map[string][]*core.Msg) error {
+	txnDialect := o.dialect.(TxnDialect)
+	loads := make([]*Load, 0, len(tableMsgMap))
+	for k, msgs := range tableMsgMap {
+		if len(msgs) == 0 {
+			continue
+		}
+		load := o.newLoad(msgs, o.metas.Routers.Maps[k])
+		err := o.retry("prepare load "+load.Label, func() error {
+			return txnDialect.Prepare(o, load)
+		})
+		if err != nil {
+			o.abortLoads(loads)
+			return err
+		}
+		loads = append(loads, load)
+	}
+	for i, load := range loads {
+		if !load.Committed {
+			err := o.retry("commit load "+load.Label, func() error {
+				err := txnDialect.Commit(o, load)
+				if err != nil && o.labelCommitted(load.TargetSchema, load.Label) {
+					// committed by a previous attempt whose response was lost
+					return nil
+				}
+				return err
+			})
+			if err != nil {
+				o.abortLoads(loads[i:])
+				return err
+			}
+			load.Committed = true
+		}
+		// prom write event number counter
+		metrics.OpsWriteProcessed.Add(float64(len(load.Content)))
+	}
+	return nil
+}
+
+func (o *Output) abortLoads(loads []*Load) {
+	txnDialect := o.dialect.(TxnDialect)
+	for _, load := range loads {
+		if load.Committed {
+			continue
+		}
+		if err := txnDialect.Abort(o, load); err != nil {
+			log.Warnf("%s abort load %s failed, err: %v", o.dialect.Name(), load.Label, err)
+			continue
+		}
+		log.Infof("%s abort load %s", o.dialect.Name(), load.Label)
+	}
+}
@@ -0,0 +1,100 @@
+package transforms
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/utils"
+	"time"
+)
+
+const AddColumnTransName = "add-column"
+
+type AddColumnTrans struct {
+	name        string
+	matchSchema string
+	matchTable  string
+	columns     []string
+	values      []*Expr
+}
+
+// NewTransform values are expressions, quote string constants, e.g. "'mysql-prod'", "_ts", "concat(first, last)",
+// numbers and booleans are constants
+func (act *AddColumnTrans) NewTransform(config map[string]interface{}) error {
+	columns, ok := config["columns"]
+	if !ok {
+		return errors.Trace(errors.New("'columns' is not configured"))
+	}
+	values, ok := config["values"]
+	if !ok {
+		return errors.Trace(errors.New("'values' is not configured"))
+	}
+
+	c, ok := utils.CastToSlice(columns)
+	if !ok {
+		return errors.Trace(errors.New("'columns' should be an array"))
+	}
+	columnsString, err := utils.CastSliceInterfaceToSliceString(c)
+	if err != nil {
+		return errors.Trace(errors.New("'columns' should be an array of string"))
+	}
+
+	v, ok := utils.CastToSlice(values)
+	if !ok {
+		return errors.Trace(errors.New("'values' should be an array"))
+	}
+	if len(c) != len(v) {
+		return errors.Trace(errors.New("'columns' should have the same length of 'values'"))
+	}
+	exprs := make([]*Expr, 0, len(v))
+	for _, value := range v {
+		var expr *Expr
+		switch value.(type) {
+		case string:
+			expr, err = CompileExpr(value.(string))
+			if err != nil {
+				return errors.Trace(err)
+			}
+		case int64, float64, bool:
+			expr = ConstExpr(value)
+		default:
+			return errors.Errorf("'values' %v should be an expression string, number or boolean", value)
+		}
+		exprs = append(exprs, expr)
+	}
+
+	act.name = AddColumnTransName
+	act.matchSchema = fmt.Sprintf("%v", config["match-schema"])
+	act.matchTable = fmt.Sprintf("%v", config["match-table"])
+	act.columns = columnsString
+	act.values = exprs
+	return nil
+}
+
+// Transform add columns to row, later columns may use earlier ones. Update old row image gets columns
+// of row only values evaluated over the old row, metadata columns stay out of it as changed columns
+func (act *AddColumnTrans) Transform(msg *core.Msg) bool {
+	if msg.Type == core.MsgDML && act.matchSchema == msg.Database && act.matchTable == msg.Table {
+		var oldMsg *core.Msg
+		if msg.DmlMsg.Old != nil {
+			m := *msg
+			m.DmlMsg = &core.DMLMsg{Action: msg.DmlMsg.Action, Data: msg.DmlMsg.Old, TableVersion: msg.DmlMsg.TableVersion}
+			oldMsg = &m
+		}
+		for i, column := range act.columns {
+			msg.DmlMsg.Data[column] = addColumnValue(act.values[i].Eval(msg))
+			if oldMsg != nil && act.values[i].RowOnly() {
+				msg.DmlMsg.Old[column] = addColumnValue(act.values[i].Eval(oldMsg))
+			}
+		}
+	}
+	return false
+}
+
+// addColumnValue times as datetime text every output accepts
+func addColumnValue(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.DateTime)
+	}
+	return value
+}
@@ -0,0 +1,235 @@
+package transforms
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/utils"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	CastColumnTransName = "cast-column"
+
+	CastAsBool     = "bool"
+	CastAsInt      = "int"
+	CastAsFloat    = "float"
+	CastAsString   = "string"
+	CastAsDatetime = "datetime" // unix seconds or datetime to datetime text in timezone
+	CastAsDate     = "date"     // unix seconds or datetime to date text in timezone
+	CastAsUnix     = "unix"     // datetime (text in timezone) to unix seconds
+	CastAsJson     = "json"     // json text to parsed object, for json based outputs
+
+	CastOnErrorFail = "fail"
+	CastOnErrorNull = "null"
+)
+
+var castAsTypes = []string{CastAsBool, CastAsInt, CastAsFloat, CastAsString, CastAsDatetime, CastAsDate, CastAsUnix, CastAsJson}
+
+// datetime text layouts accepted, mysql datetime first
+var castDatetimeLayouts = []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano, time.DateOnly}
+
+type CastColumnTrans struct {
+	name        string
+	matchSchema string
+	matchTable  string
+	columns     []string
+	castAs      []string
+	location    *time.Location
+	onError     string
+}
+
+func (cct *CastColumnTrans) NewTransform(config map[string]interface{}) error {
+	columns, ok := config["columns"]
+	if !ok {
+		return errors.Trace(errors.New("'columns' is not configured"))
+	}
+	castAs, ok := config["cast-as"]
+	if !ok {
+		return errors.Trace(errors.New("'cast-as' is not configured"))
+	}
+
+	c, ok := utils.CastToSlice(columns)
+	if !ok {
+		return errors.Trace(errors.New("'columns' should be an array"))
+	}
+	columnsString, err := utils.CastSliceInterfaceToSliceString(c)
+	if err != nil {
+		return errors.Trace(errors.New("'columns' should be an array of string"))
+	}
+
+	ca, ok := utils.CastToSlice(castAs)
+	if !ok {
+		return errors.Trace(errors.New("'cast-as' should be an array"))
+	}
+	castAsString, err := utils.CastSliceInterfaceToSliceString(ca)
+	if err != nil {
+		return errors.Trace(errors.New("'cast-as' should be an array of string"))
+	}
+	if len(c) != len(ca) {
+		return errors.Trace(errors.New("'columns' should have the same length of 'cast-as'"))
+	}
+	for _, typ := range castAsString {
+		if !slices.Contains(castAsTypes, typ) {
+			return errors.Errorf("unknown 'cast-as' type: %s, support %s", typ, strings.Join(castAsTypes, ", "))
+		}
+	}
+
+	cct.location = time.Local
+	if timezone, ok := config["timezone"]; ok {
+		if cct.location, err = time.LoadLocation(fmt.Sprintf("%v", timezone)); err != nil {
+			return errors.Errorf("'timezone' %v: %v", timezone, err)
+		}
+	}
+	cct.onError = CastOnErrorFail
+	if onError, ok := config["on-error"]; ok {
+		cct.onError = fmt.Sprintf("%v", onError)
+	}
+	if cct.onError != CastOnErrorFail && cct.onError != CastOnErrorNull {
+		return errors.Errorf("unknown 'on-error': %s, support %s, %s", cct.onError, CastOnErrorFail, CastOnErrorNull)
+	}
+
+	cct.name = CastColumnTransName
+	cct.matchSchema = fmt.Sprintf("%v", config["match-schema"])
+	cct.matchTable = fmt.Sprintf("%v", config["match-table"])
+	cct.columns = columnsString
+	cct.castAs = castAsString
+	return nil
+}
+
+// Transform cast columns of data and old row images, a failed cast stops the pipeline or is null by on-error
+func (cct *CastColumnTrans) Transform(msg *core.Msg) bool {
+	if msg.Type == core.MsgDML && cct.matchSchema == msg.Database && cct.matchTable == msg.Table {
+		for _, row := range []map[string]interface{}{msg.DmlMsg.Data, msg.DmlMsg.Old} {
+			for i, column := range cct.columns {
+				value := FindColumn(row, column)
+				if value == nil {
+					continue
+				}
+				castValue, err := cct.cast(value, cct.castAs[i])
+				if err != nil {
+					if cct.onError == CastOnErrorFail {
+						log.Fatalf("transform %s %s.%s column %s: %v", CastColumnTransName, msg.Database, msg.Table, column, err)
+					}
+					log.Warnf("transform %s %s.%s column %s: %v, set null", CastColumnTransName, msg.Database, msg.Table, column, err)
+				}
+				row[column] = castValue
+			}
+		}
+	}
+	return false
+}
+
+func (cct *CastColumnTrans) cast(value interface{}, castAs string) (interface{}, error) {
+	switch castAs {
+	case CastAsBool:
+		return castBool(value)
+	case CastAsInt:
+		return castInt(value)
+	case CastAsFloat:
+		return castFloat(value)
+	case CastAsString:
+		return exprString(value), nil
+	case CastAsDatetime, CastAsDate:
+		t, err := cct.castTime(value)
+		if err != nil {
+			return nil, err
+		}
+		if castAs == CastAsDate {
+			return t.Format(time.DateOnly), nil
+		}
+		if t.Nanosecond() == 0 {
+			return t.Format(time.DateTime), nil
+		}
+		return t.Format("2006-01-02 15:04:05.999999"), nil
+	case CastAsUnix:
+		t, err := cct.castTime(value)
+		if err != nil {
+			return nil, err
+		}
+		return t.Unix(), nil
+	case CastAsJson:
+		return castJson(value)
+	}
+	return nil, errors.Errorf("unknown cast type %s", castAs)
+}
+
+func castBool(value interface{}) (interface{}, error) {
+	if b, ok := value.(bool); ok {
+		return b, nil
+	}
+	if i, ok := exprInt(value); ok {
+		return i != 0, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(exprString(value))) {
+	case "true", "yes", "y", "on":
+		return true, nil
+	case "false", "no", "n", "off":
+		return false, nil
+	}
+	return nil, errors.Errorf("can not cast %v to %s", value, CastAsBool)
+}
+
+// castInt integral values only, 1.5 is an error rather than truncated
+func castInt(value interface{}) (interface{}, error) {
+	if v, ok := value.(uint64); ok {
+		return v, nil
+	}
+	if i, ok := exprInt(value); ok {
+		return i, nil
+	}
+	if f, ok := exprFloat(value); ok && f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+		return int64(f), nil
+	}
+	return nil, errors.Errorf("can not cast %v to %s", value, CastAsInt)
+}
+
+func castFloat(value interface{}) (interface{}, error) {
+	if f, ok := exprFloat(value); ok {
+		return f, nil
+	}
+	return nil, errors.Errorf("can not cast %v to %s", value, CastAsFloat)
+}
+
+// castTime numbers are unix seconds, text without zone is in the configured timezone
+func (cct *CastColumnTrans) castTime(value interface{}) (time.Time, error) {
+	if t, ok := value.(time.Time); ok {
+		return t.In(cct.location), nil
+	}
+	if i, ok := exprInt(value); ok {
+		return time.Unix(i, 0).In(cct.location), nil
+	}
+	if f, ok := exprFloat(value); ok {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).In(cct.location), nil
+	}
+	s := strings.TrimSpace(exprString(value))
+	for _, layout := range castDatetimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, cct.location); err == nil {
+			return t.In(cct.location), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("can not cast %v to time", value)
+}
+
+// castJson parse json text, numbers keep their text, big integers are not rounded
+func castJson(value interface{}) (interface{}, error) {
+	switch value.(type) {
+	case string, []byte:
+	default:
+		return value, nil // already parsed
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(exprString(value))))
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, errors.Errorf("can not cast %v to %s: %v", value, CastAsJson, err)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,896 @@
+package transforms
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sqlpub/qin-cdc/core"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// expression language of transforms, sql like:
+//   literals 1, 1.5, 'text', true, false, null
+//   columns  name, `name`, old.name (update old row image), a backticked name is always a column
+//   metadata _op (insert, update, delete, replace), _ts (source event time), _gtid, _schema, _table
+//   operators or, and, not, = != <> < <= > >=, is [not] null, [not] in (...), [not] like '%x_', + - * / %
+//   functions lower, upper, length, trim, concat, coalesce, if, abs
+// null compares to nothing, a null condition is false
+
+const (
+	exprOldPrefix = "old"
+
+	exprMetaOp     = "_op"
+	exprMetaTs     = "_ts"
+	exprMetaGtid   = "_gtid"
+	exprMetaSchema = "_schema"
+	exprMetaTable  = "_table"
+)
+
+// exprFuncArgs function name -> min args, max args (-1 for any)
+var exprFuncArgs = map[string][2]int{
+	"lower":    {1, 1},
+	"upper":    {1, 1},
+	"length":   {1, 1},
+	"trim":     {1, 1},
+	"concat":   {1, -1},
+	"coalesce": {1, -1},
+	"if":       {3, 3},
+	"abs":      {1, 1},
+}
+
+// Expr compiled expression
+type Expr struct {
+	raw     string
+	root    exprNode
+	columns []string // data columns referenced, old row image columns included
+	meta    bool     // metadata referenced, value depends on the event, not only on the row
+}
+
+type exprNode interface {
+	eval(msg *core.Msg) interface{}
+}
+
+// CompileExpr parse expression, syntax errors, unknown functions and wrong argument counts fail here
+func CompileExpr(raw string) (*Expr, error) {
+	tokens, err := lexExpr(raw)
+	if err != nil {
+		return nil, errors.Errorf("expression %q: %v", raw, err)
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = errors.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, errors.Errorf("expression %q: %v", raw, err)
+	}
+	return &Expr{raw: raw, root: root, columns: p.columns, meta: p.meta}, nil
+}
+
+// ConstExpr expression of a constant value
+func ConstExpr(value interface{}) *Expr {
+	return &Expr{raw: fmt.Sprintf("%v", value), root: &literalNode{value: value}}
+}
+
+// Eval value of expression over msg
+func (e *Expr) Eval(msg *core.Msg) interface{} {
+	return e.root.eval(msg)
+}
+
+// Match expression is true over msg, null is false
+func (e *Expr) Match(msg *core.Msg) bool {
+	return exprTruthy(e.Eval(msg))
+}
+
+// Columns data columns referenced by expression
+func (e *Expr) Columns() []string {
+	return e.columns
+}
+
+// RowOnly value depends on row columns and constants only, not on event metadata
+func (e *Expr) RowOnly() bool {
+	return !e.meta
+}
+
+func (e *Expr) String() string {
+	return e.raw
+}
+
+// lexer
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenQuotedIdent // `name`, never a keyword, function or metadata
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+}
+
+func lexExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '$') {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokenIdent, string(rs[i:j])})
+			i = j
+		case r == '`':
+			j := i + 1
+			for j < len(rs) && rs[j] != '`' {
+				j++
+			}
+			if j == len(rs) {
+				return nil, errors.New("unterminated `")
+			}
+			tokens = append(tokens, exprToken{tokenQuotedIdent, string(rs[i+1 : j])})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E' ||
+				((rs[j] == '+' || rs[j] == '-') && (rs[j-1] == 'e' || rs[j-1] == 'E'))) {
+				j++
+			}
+			if _, err := strconv.ParseFloat(string(rs[i:j]), 64); err != nil {
+				return nil, errors.Errorf("invalid number %s", string(rs[i:j]))
+			}
+			tokens = append(tokens, exprToken{tokenNumber, string(rs[i:j])})
+			i = j
+		case r == '\'' || r == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs); j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+					sb.WriteRune(rs[j])
+					continue
+				}
+				if rs[j] == r {
+					if j+1 < len(rs) && rs[j+1] == r { // '' escape
+						sb.WriteRune(r)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, errors.Errorf("unterminated %c", r)
+			}
+			tokens = append(tokens, exprToken{tokenString, sb.String()})
+			i = j + 1
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<>", "<=", ">=", "&&", "||", "=", "<", ">", "+", "-", "*", "/", "%", "(", ")", ",", ".", "!"} {
+				if strings.HasPrefix(string(rs[i:min(i+2, len(rs))]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, errors.Errorf("unexpected character %c", r)
+			}
+			tokens = append(tokens, exprToken{tokenOp, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: tokenEOF}), nil
+}
+
+// parser
+
+type exprParser struct {
+	tokens  []exprToken
+	pos     int
+	columns []string
+	meta    bool
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword next token is the case-insensitive keyword, consumed if so
+func (p *exprParser) keyword(words ...string) bool {
+	t := p.peek()
+	if t.kind != tokenIdent {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) op(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOp {
+		return "", false
+	}
+	for _, o := range ops {
+		if t.text == o {
+			p.pos++
+			return o, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.op(op); !ok {
+		return errors.Errorf("expected %q, got %q", op, p.peek().text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.op("||"); !ok && !p.keyword("or") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{and: false, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.op("&&"); !ok && !p.keyword("and") {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{and: true, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.op("!"); ok || p.keyword("not") {
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node: node}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.op("==", "=", "!=", "<>", "<=", ">=", "<", ">"); ok {
+		right, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+	}
+	if p.keyword("is") {
+		not := p.keyword("not")
+		if !p.keyword("null") {
+			return nil, errors.Errorf("expected null after is, got %q", p.peek().text)
+		}
+		return &isNullNode{not: not, node: left}, nil
+	}
+	not := p.keyword("not")
+	switch {
+	case p.keyword("in"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &inNode{not: not, node: left, list: list}, nil
+	case p.keyword("like"):
+		t := p.next()
+		if t.kind != tokenString {
+			return nil, errors.Errorf("like pattern should be a string, got %q", t.text)
+		}
+		return &likeNode{not: not, node: left, pattern: likePattern(t.text)}, nil
+	case not:
+		return nil, errors.Errorf("expected in or like after not, got %q", p.peek().text)
+	}
+	return left, nil
+}
+
+// parseList comma separated expressions until )
+func (p *exprParser) parseList() ([]exprNode, error) {
+	var list []exprNode
+	if _, ok := p.op(")"); ok {
+		return list, nil
+	}
+	for {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, node)
+		if _, ok := p.op(","); ok {
+			continue
+		}
+		return list, p.expect(")")
+	}
+}
+
+func (p *exprParser) parseAdd() (exprNode, error) {
+	left, err := p.parseMul()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.op("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMul()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseMul() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.op("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.op("-"); ok {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &arithNode{op: "-", left: &literalNode{value: int64(0)}, right: node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &literalNode{value: i}, nil
+		}
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return &literalNode{value: f}, nil
+	case tokenString:
+		return &literalNode{value: t.text}, nil
+	case tokenOp:
+		if t.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		}
+	case tokenQuotedIdent:
+		p.columns = append(p.columns, t.text)
+		return &columnNode{name: t.text}, nil
+	case tokenIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		if _, ok := p.op("("); ok {
+			return p.parseFunc(strings.ToLower(t.text))
+		}
+		switch t.text {
+		case exprMetaOp, exprMetaTs, exprMetaGtid, exprMetaSchema, exprMetaTable:
+			p.meta = true
+			return &metaNode{name: t.text}, nil
+		}
+		if strings.EqualFold(t.text, exprOldPrefix) {
+			if _, ok := p.op("."); ok {
+				column := p.next()
+				if column.kind != tokenIdent && column.kind != tokenQuotedIdent {
+					return nil, errors.Errorf("expected column after old., got %q", column.text)
+				}
+				p.columns = append(p.columns, column.text)
+				return &columnNode{name: column.text, old: true}, nil
+			}
+		}
+		p.columns = append(p.columns, t.text)
+		return &columnNode{name: t.text}, nil
+	case tokenEOF:
+		return nil, errors.New("unexpected end")
+	}
+	return nil, errors.Errorf("unexpected %q", t.text)
+}
+
+func (p *exprParser) parseFunc(name string) (exprNode, error) {
+	argCount, ok := exprFuncArgs[name]
+	if !ok {
+		return nil, errors.Errorf("unknown function %s", name)
+	}
+	args, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < argCount[0] || (argCount[1] >= 0 && len(args) > argCount[1]) {
+		return nil, errors.Errorf("function %s wrong number of arguments: %d", name, len(args))
+	}
+	return &funcNode{name: name, args: args}, nil
+}
+
+// nodes
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(*core.Msg) interface{} {
+	return n.value
+}
+
+type columnNode struct {
+	name string
+	old  bool
+}
+
+func (n *columnNode) eval(msg *core.Msg) interface{} {
+	if msg.DmlMsg == nil {
+		return nil
+	}
+	if n.old {
+		return FindColumn(msg.DmlMsg.Old, n.name)
+	}
+	return FindColumn(msg.DmlMsg.Data, n.name)
+}
+
+type metaNode struct {
+	name string
+}
+
+func (n *metaNode) eval(msg *core.Msg) interface{} {
+	switch n.name {
+	case exprMetaOp:
+		if msg.DmlMsg == nil {
+			return nil
+		}
+		return string(msg.DmlMsg.Action)
+	case exprMetaTs:
+		return msg.Timestamp
+	case exprMetaGtid:
+		return msg.InputContext.Gtid
+	case exprMetaSchema:
+		return msg.Database
+	case exprMetaTable:
+		return msg.Table
+	}
+	return nil
+}
+
+type logicNode struct {
+	and         bool
+	left, right exprNode
+}
+
+func (n *logicNode) eval(msg *core.Msg) interface{} {
+	left := exprTruthy(n.left.eval(msg))
+	if n.and != left { // false and, true or
+		return left
+	}
+	return exprTruthy(n.right.eval(msg))
+}
+
+type notNode struct {
+	node exprNode
+}
+
+func (n *notNode) eval(msg *core.Msg) interface{} {
+	value := n.node.eval(msg)
+	if value == nil {
+		return nil
+	}
+	return !exprTruthy(value)
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *compareNode) eval(msg *core.Msg) interface{} {
+	c, ok := exprCompare(n.left.eval(msg), n.right.eval(msg))
+	if !ok {
+		return nil
+	}
+	switch n.op {
+	case "=", "==":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return nil
+}
+
+type isNullNode struct {
+	not  bool
+	node exprNode
+}
+
+func (n *isNullNode) eval(msg *core.Msg) interface{} {
+	return (n.node.eval(msg) == nil) != n.not
+}
+
+type inNode struct {
+	not  bool
+	node exprNode
+	list []exprNode
+}
+
+// eval not found with a null in the list is null, as in sql
+func (n *inNode) eval(msg *core.Msg) interface{} {
+	value := n.node.eval(msg)
+	if value == nil {
+		return nil
+	}
+	hasNull := false
+	for _, item := range n.list {
+		itemValue := item.eval(msg)
+		if itemValue == nil {
+			hasNull = true
+			continue
+		}
+		if c, ok := exprCompare(value, itemValue); ok && c == 0 {
+			return !n.not
+		}
+	}
+	if hasNull {
+		return nil
+	}
+	return n.not
+}
+
+type likeNode struct {
+	not     bool
+	node    exprNode
+	pattern *regexp.Regexp
+}
+
+func likePattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+func (n *likeNode) eval(msg *core.Msg) interface{} {
+	value := n.node.eval(msg)
+	if value == nil {
+		return nil
+	}
+	return n.pattern.MatchString(exprString(value)) != n.not
+}
+
+type arithNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *arithNode) eval(msg *core.Msg) interface{} {
+	left, right := n.left.eval(msg), n.right.eval(msg)
+	li, lInt := exprInt(left)
+	ri, rInt := exprInt(right)
+	if lInt && rInt {
+		switch n.op {
+		case "+":
+			return li + ri
+		case "-":
+			return li - ri
+		case "*":
+			return li * ri
+		case "%":
+			if ri == 0 {
+				return nil
+			}
+			return li % ri
+		}
+	}
+	lf, lOk := exprFloat(left)
+	rf, rOk := exprFloat(right)
+	if !lOk || !rOk {
+		return nil
+	}
+	switch n.op {
+	case "+":
+		return lf + rf
+	case "-":
+		return lf - rf
+	case "*":
+		return lf * rf
+	case "/":
+		if rf == 0 {
+			return nil
+		}
+		return lf / rf
+	case "%":
+		if rf == 0 {
+			return nil
+		}
+		return math.Mod(lf, rf)
+	}
+	return nil
+}
+
+type funcNode struct {
+	name string
+	args []exprNode
+}
+
+func (n *funcNode) eval(msg *core.Msg) interface{} {
+	switch n.name {
+	case "coalesce":
+		for _, arg := range n.args {
+			if value := arg.eval(msg); value != nil {
+				return value
+			}
+		}
+		return nil
+	case "if":
+		if exprTruthy(n.args[0].eval(msg)) {
+			return n.args[1].eval(msg)
+		}
+		return n.args[2].eval(msg)
+	case "concat":
+		var sb strings.Builder
+		for _, arg := range n.args {
+			value := arg.eval(msg)
+			if value == nil {
+				return nil
+			}
+			sb.WriteString(exprString(value))
+		}
+		return sb.String()
+	}
+	value := n.args[0].eval(msg)
+	if value == nil {
+		return nil
+	}
+	switch n.name {
+	case "lower":
+		return strings.ToLower(exprString(value))
+	case "upper":
+		return strings.ToUpper(exprString(value))
+	case "trim":
+		return strings.TrimSpace(exprString(value))
+	case "length":
+		return int64(len(exprString(value)))
+	case "abs":
+		if i, ok := exprInt(value); ok {
+			if i < 0 {
+				return -i
+			}
+			return i
+		}
+		if f, ok := exprFloat(value); ok {
+			return math.Abs(f)
+		}
+	}
+	return nil
+}
+
+// values
+
+func exprTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		if f, ok := exprFloat(v); ok {
+			return f != 0
+		}
+		return v != ""
+	}
+	if f, ok := exprFloat(value); ok {
+		return f != 0
+	}
+	return true
+}
+
+// exprInt integer value, strings of integers included
+func exprInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), true
+		}
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return i, err == nil
+	case []byte:
+		return exprInt(string(v))
+	}
+	return 0, false
+}
+
+// exprFloat numeric value, strings of numbers included
+func exprFloat(value interface{}) (float64, bool) {
+	if i, ok := exprInt(value); ok {
+		return float64(i), true
+	}
+	switch v := value.(type) {
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case []byte:
+		return exprFloat(string(v))
+	case fmt.Stringer: // decimal.Decimal
+		return exprFloat(v.String())
+	}
+	return 0, false
+}
+
+func exprString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func exprIsString(value interface{}) bool {
+	switch value.(type) {
+	case string, []byte:
+		return true
+	}
+	return false
+}
+
+// exprCompare two strings compare as strings, numbers as numbers if the other side is numeric,
+// times as times, others as strings, not comparable with null
+func exprCompare(left interface{}, right interface{}) (int, bool) {
+	if left == nil || right == nil {
+		return 0, false
+	}
+	if exprIsString(left) && exprIsString(right) {
+		return strings.Compare(exprString(left), exprString(right)), true
+	}
+	if lt, ok := left.(time.Time); ok {
+		if rt, ok := right.(time.Time); ok {
+			return lt.Compare(rt), true
+		}
+	}
+	if li, ok := exprInt(left); ok {
+		if ri, ok := exprInt(right); ok {
+			switch {
+			case li < ri:
+				return -1, true
+			case li > ri:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if lf, ok := exprFloat(left); ok {
+		if rf, ok := exprFloat(right); ok {
+			switch {
+			case lf < rf:
+				return -1, true
+			case lf > rf:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return strings.Compare(exprString(left), exprString(right)), true
+}
@@ -0,0 +1,201 @@
+package transforms
+
+import (
+	"github.com/sqlpub/qin-cdc/core"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testExprMsg() *core.Msg {
+	msg := &core.Msg{Database: "db", Table: "orders", Type: core.MsgDML, DmlMsg: &core.DMLMsg{
+		Action: core.UpdateAction,
+		Data: map[string]interface{}{
+			"id": int32(7), "name": "O'Brien", "amount": 12.5, "qty": "3", "note": nil,
+			"_op": "column", "old": int64(1), "status": uint64(2),
+			"created": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		Old: map[string]interface{}{"id": int32(7), "name": "Brien", "_op": "old column"},
+	}}
+	msg.InputContext.Gtid = "uuid:9"
+	return msg
+}
+
+func TestExprLex(t *testing.T) {
+	tests := []struct {
+		expr  string
+		kinds []tokenKind
+		texts []string
+	}{
+		{`'it''s' "a\"b" 'c\\d'`, []tokenKind{tokenString, tokenString, tokenString}, []string{"it's", `a"b`, `c\d`}},
+		{"1 1.5 .5 1e3 2.5E-2", []tokenKind{tokenNumber, tokenNumber, tokenNumber, tokenNumber, tokenNumber},
+			[]string{"1", "1.5", ".5", "1e3", "2.5E-2"}},
+		{"`my col` old.`x` a_1$", []tokenKind{tokenQuotedIdent, tokenIdent, tokenOp, tokenQuotedIdent, tokenIdent},
+			[]string{"my col", "old", ".", "x", "a_1$"}},
+		{"a<>b<=c!=d==e", []tokenKind{tokenIdent, tokenOp, tokenIdent, tokenOp, tokenIdent, tokenOp, tokenIdent, tokenOp, tokenIdent},
+			[]string{"a", "<>", "b", "<=", "c", "!=", "d", "==", "e"}},
+	}
+	for _, tt := range tests {
+		tokens, err := lexExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		tokens = tokens[:len(tokens)-1] // eof
+		if len(tokens) != len(tt.kinds) {
+			t.Fatalf("%s: tokens %v", tt.expr, tokens)
+		}
+		for i, token := range tokens {
+			if token.kind != tt.kinds[i] || token.text != tt.texts[i] {
+				t.Errorf("%s: token %d = %v, want %v %q", tt.expr, i, token, tt.kinds[i], tt.texts[i])
+			}
+		}
+	}
+	for _, expr := range []string{"'abc", "`abc", "1.2.3", "a # b"} {
+		if _, err := lexExpr(expr); err == nil {
+			t.Errorf("%s: expected lex error", expr)
+		}
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		// precedence
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"10 - 4 - 3", int64(3)},
+		{"-2 * 3 + 10 % 4", int64(-4)},
+		{"7 / 2", 3.5},
+		{"true or false and false", true},
+		{"(true or false) and false", false},
+		{"not false and false", false},
+		{"not 1 = 2", true},
+		{"1 = 1 || 0 && 0", true},
+		{"!(id = 7)", false},
+		// null semantics
+		{"note = null", nil},
+		{"note != 1", nil},
+		{"not note", nil},
+		{"not (note = 1)", nil},
+		{"note is null", true},
+		{"name is not null", true},
+		{"note in (1, 2)", nil},
+		{"id in (1, 7)", true},
+		{"id in (1, null)", nil},
+		{"id not in (1, null)", nil},
+		{"id not in (1, 2)", true},
+		{"note like '%'", nil},
+		{"note not like '%'", nil},
+		{"note + 1", nil},
+		{"1 / 0", nil},
+		{"concat(name, note)", nil},
+		{"coalesce(note, name)", "O'Brien"},
+		{"if(note, 1, 2)", int64(2)},
+		// like
+		{"name like 'O''B%'", true},
+		{"name like '_''Brien'", true},
+		{"name like 'o%'", false},
+		{"name not like '%x%'", true},
+		// old row image
+		{"old.name", "Brien"},
+		{"old.name != name", true},
+		{"old.`_op`", "old column"},
+		{"old.missing is null", true},
+		// backticked names are columns, bare names are metadata or keywords
+		{"_op", "update"},
+		{"`_op`", "column"},
+		{"`old`", int64(1)},
+		{"_gtid", "uuid:9"},
+		{"_schema = 'db' and _table = 'orders'", true},
+		// mixed types
+		{"qty = 3", true},
+		{"qty > 20", false},
+		{"qty > '20'", true}, // both strings compare as strings
+		{"amount > 12", true},
+		{"id = 7.0", true},
+		{"status = 2", true},
+		{"created > '2024-01-01'", true},
+		{"true = 1", true},
+		{"length(name)", int64(7)},
+		{"upper(trim(' a '))", "A"},
+		{"abs(-2.5)", 2.5},
+	}
+	msg := testExprMsg()
+	for _, tt := range tests {
+		expr, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := expr.Eval(msg); got != tt.want {
+			t.Errorf("%s = %v (%T), want %v (%T)", tt.expr, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestExprCompileError(t *testing.T) {
+	for _, expr := range []string{
+		"nope(1)",     // unknown function
+		"lower(a, b)", // wrong number of arguments
+		"if(a, b)",    // wrong number of arguments
+		"concat()",    // wrong number of arguments
+		"a = ",        // unexpected end
+		"a b",         // trailing token
+		"(a = 1",      // missing )
+		"a like b",    // like pattern not a string
+		"a not 1",     // not without in or like
+		"a is 1",      // is without null
+		"old.1",       // old without column
+		"a in 1",      // in without list
+		"`lower`(a)",  // backticked name is not a function
+	} {
+		if _, err := CompileExpr(expr); err == nil {
+			t.Errorf("%s: expected compile error", expr)
+		}
+	}
+}
+
+func TestExprColumns(t *testing.T) {
+	expr, err := CompileExpr("`_op` = 'x' and old.name != name or _ts is null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(expr.Columns(), []string{"_op", "name", "name"}) {
+		t.Errorf("columns = %v", expr.Columns())
+	}
+	if expr.RowOnly() {
+		t.Errorf("_ts referenced, expression is not row only")
+	}
+	if expr, _ = CompileExpr("`_ts` is null"); !expr.RowOnly() {
+		t.Errorf("backticked _ts is a column, expression is row only")
+	}
+}
+
+func TestExprCompare(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		left, right interface{}
+		c           int
+		ok          bool
+	}{
+		{nil, 1, 0, false},
+		{1, nil, 0, false},
+		{"b", "a", 1, true},
+		{[]byte("a"), "a", 0, true},
+		{int8(1), uint64(1), 0, true},
+		{uint64(1 << 63), int64(1), 1, true},
+		{"10", 9, 1, true},
+		{"10", "9", -1, true},
+		{1.5, int32(2), -1, true},
+		{now, now.Add(time.Second), -1, true},
+		{"abc", 1, 1, true},
+		{true, int64(1), 0, true},
+	}
+	for _, tt := range tests {
+		c, ok := exprCompare(tt.left, tt.right)
+		if c != tt.c || ok != tt.ok {
+			t.Errorf("exprCompare(%v, %v) = %d, %v, want %d, %v", tt.left, tt.right, c, ok, tt.c, tt.ok)
+		}
+	}
+}
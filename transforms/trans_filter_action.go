@@ -0,0 +1,121 @@
+package transforms
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	FilterActionTransName = "filter-action"
+
+	DefaultSoftDeleteColumn = "is_deleted"
+	DefaultDeletedAtColumn  = "deleted_at"
+)
+
+var filterActions = []string{string(core.InsertAction), string(core.UpdateAction), string(core.DeleteAction), string(core.ReplaceAction)}
+
+// FilterActionTrans drop rows of ignored actions, or keep deleted rows by converting deletes
+// to updates of the soft delete columns
+type FilterActionTrans struct {
+	name             string
+	matchSchema      string
+	matchTable       string
+	ignoreActions    []core.ActionType
+	softDelete       bool
+	softDeleteColumn string
+	deletedAtColumn  string
+}
+
+func (fat *FilterActionTrans) NewTransform(config map[string]interface{}) error {
+	if ignoreActions, ok := config["ignore-actions"]; ok {
+		ia, ok := utils.CastToSlice(ignoreActions)
+		if !ok {
+			return errors.Trace(errors.New("'ignore-actions' should be an array"))
+		}
+		ignoreActionsString, err := utils.CastSliceInterfaceToSliceString(ia)
+		if err != nil {
+			return errors.Trace(errors.New("'ignore-actions' should be an array of string"))
+		}
+		for _, action := range ignoreActionsString {
+			if !slices.Contains(filterActions, action) {
+				return errors.Errorf("unknown 'ignore-actions' action: %s, support %s", action, strings.Join(filterActions, ", "))
+			}
+			fat.ignoreActions = append(fat.ignoreActions, core.ActionType(action))
+		}
+	}
+	if softDelete, ok := config["soft-delete"]; ok {
+		if fat.softDelete, ok = softDelete.(bool); !ok {
+			return errors.Trace(errors.New("'soft-delete' should be a boolean"))
+		}
+	}
+	if fat.softDelete && slices.Contains(fat.ignoreActions, core.DeleteAction) {
+		return errors.Trace(errors.New("'soft-delete' can not be used with ignored delete action"))
+	}
+	if len(fat.ignoreActions) == 0 && !fat.softDelete {
+		return errors.Trace(errors.New("'ignore-actions' or 'soft-delete' is not configured"))
+	}
+
+	fat.softDeleteColumn = DefaultSoftDeleteColumn
+	if softDeleteColumn, ok := config["soft-delete-column"]; ok {
+		fat.softDeleteColumn = fmt.Sprintf("%v", softDeleteColumn)
+	}
+	fat.deletedAtColumn = DefaultDeletedAtColumn
+	if deletedAtColumn, ok := config["deleted-at-column"]; ok {
+		fat.deletedAtColumn = fmt.Sprintf("%v", deletedAtColumn)
+	}
+
+	fat.name = FilterActionTransName
+	fat.matchSchema = fmt.Sprintf("%v", config["match-schema"])
+	fat.matchTable = fmt.Sprintf("%v", config["match-table"])
+	return nil
+}
+
+// SoftDeleteColumns columns written by soft delete, none if disabled
+func (fat *FilterActionTrans) SoftDeleteColumns() []string {
+	if !fat.softDelete {
+		return nil
+	}
+	return []string{fat.softDeleteColumn, fat.deletedAtColumn}
+}
+
+// Transform drop rows of ignored actions, with soft delete a delete becomes an update setting
+// soft delete column 1 and deleted at the event time, other rows set soft delete column 0,
+// so a row inserted again after delete is visible again
+func (fat *FilterActionTrans) Transform(msg *core.Msg) bool {
+	if msg.Type != core.MsgDML || fat.matchSchema != msg.Database || fat.matchTable != msg.Table {
+		return false
+	}
+	if slices.Contains(fat.ignoreActions, msg.DmlMsg.Action) {
+		return true
+	}
+	if !fat.softDelete {
+		return false
+	}
+	if msg.DmlMsg.Action == core.DeleteAction {
+		old := msg.DmlMsg.Data
+		data := make(map[string]interface{}, len(old)+2)
+		for column, value := range old {
+			data[column] = value
+		}
+		old[fat.softDeleteColumn] = 0
+		old[fat.deletedAtColumn] = nil
+		data[fat.softDeleteColumn] = 1
+		data[fat.deletedAtColumn] = msg.Timestamp.Format(time.DateTime)
+		msg.DmlMsg.Action = core.UpdateAction
+		msg.DmlMsg.Data = data
+		msg.DmlMsg.Old = old
+		return false
+	}
+	for _, row := range []map[string]interface{}{msg.DmlMsg.Data, msg.DmlMsg.Old} {
+		if row != nil {
+			row[fat.softDeleteColumn] = 0
+			row[fat.deletedAtColumn] = nil
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package transforms
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sqlpub/qin-cdc/core"
+)
+
+const FilterRowTransName = "filter-row"
+
+type FilterRowTrans struct {
+	name        string
+	matchSchema string
+	matchTable  string
+	expression  *Expr
+}
+
+func (frt *FilterRowTrans) NewTransform(config map[string]interface{}) error {
+	expression, ok := config["expression"]
+	if !ok {
+		return errors.Trace(errors.New("'expression' is not configured"))
+	}
+	expressionString, ok := expression.(string)
+	if !ok {
+		return errors.Trace(errors.New("'expression' should be a string"))
+	}
+	expr, err := CompileExpr(expressionString)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	frt.name = FilterRowTransName
+	frt.matchSchema = fmt.Sprintf("%v", config["match-schema"])
+	frt.matchTable = fmt.Sprintf("%v", config["match-table"])
+	frt.expression = expr
+	return nil
+}
+
+// Transform drop the row if expression is true
+func (frt *FilterRowTrans) Transform(msg *core.Msg) bool {
+	if msg.Type == core.MsgDML && frt.matchSchema == msg.Database && frt.matchTable == msg.Table {
+		return frt.expression.Match(msg)
+	}
+	return false
+}
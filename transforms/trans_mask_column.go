@@ -0,0 +1,221 @@
+package transforms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sqlpub/qin-cdc/core"
+	"github.com/sqlpub/qin-cdc/utils"
+	"path"
+	"strings"
+)
+
+const (
+	MaskColumnTransName = "mask-column"
+
+	MaskStrategyHash           = "hash"            // hex sha256 of salt and value
+	MaskStrategyKeep           = "keep"            // keep first and last n chars, mask others
+	MaskStrategyNull           = "null"            // null out
+	MaskStrategyFormatPreserve = "format-preserve" // digits to digits, letters to letters, keyed by salt
+
+	DefaultMaskChar = "*"
+)
+
+// MaskColumnTrans match-schema, match-table and columns are glob patterns, e.g. "user_*", "*phone*",
+// values are masked as text in both row images
+type MaskColumnTrans struct {
+	name         string
+	matchSchema  string
+	matchTable   string
+	columns      []string
+	strategy     string
+	salt         string
+	keepFirst    int
+	keepLast     int
+	maskChar     string
+	tables       map[string]bool            // schema.table -> matched
+	tableColumns map[string]map[string]bool // schema.table -> column -> matched
+}
+
+func (mct *MaskColumnTrans) NewTransform(config map[string]interface{}) error {
+	columns, ok := config["columns"]
+	if !ok {
+		return errors.Trace(errors.New("'columns' is not configured"))
+	}
+	c, ok := utils.CastToSlice(columns)
+	if !ok {
+		return errors.Trace(errors.New("'columns' should be an array"))
+	}
+	columnsString, err := utils.CastSliceInterfaceToSliceString(c)
+	if err != nil {
+		return errors.Trace(errors.New("'columns' should be an array of string"))
+	}
+
+	mct.name = MaskColumnTransName
+	mct.matchSchema = fmt.Sprintf("%v", config["match-schema"])
+	mct.matchTable = fmt.Sprintf("%v", config["match-table"])
+	mct.columns = columnsString
+	for _, pattern := range append([]string{mct.matchSchema, mct.matchTable}, mct.columns...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("bad pattern %q: %v", pattern, err)
+		}
+	}
+
+	mct.strategy = fmt.Sprintf("%v", config["strategy"])
+	switch mct.strategy {
+	case MaskStrategyHash, MaskStrategyFormatPreserve, MaskStrategyNull:
+	case MaskStrategyKeep:
+		if mct.keepFirst, err = maskIntOption(config, "keep-first"); err != nil {
+			return err
+		}
+		if mct.keepLast, err = maskIntOption(config, "keep-last"); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown 'strategy': %s, support %s, %s, %s, %s",
+			mct.strategy, MaskStrategyHash, MaskStrategyKeep, MaskStrategyNull, MaskStrategyFormatPreserve)
+	}
+	if salt, ok := config["salt"]; ok {
+		mct.salt = fmt.Sprintf("%v", salt)
+	}
+	mct.maskChar = DefaultMaskChar
+	if maskChar, ok := config["mask-char"]; ok {
+		mct.maskChar = fmt.Sprintf("%v", maskChar)
+	}
+	mct.tables = make(map[string]bool)
+	mct.tableColumns = make(map[string]map[string]bool)
+	return nil
+}
+
+func maskIntOption(config map[string]interface{}, name string) (int, error) {
+	value, ok := config[name]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := value.(int64)
+	if !ok || n < 0 {
+		return 0, errors.Errorf("'%s' should be a non-negative integer", name)
+	}
+	return int(n), nil
+}
+
+// MatchTable schema and table match patterns
+func (mct *MaskColumnTrans) MatchTable(schema string, table string) bool {
+	schemaMatched, _ := path.Match(mct.matchSchema, schema)
+	tableMatched, _ := path.Match(mct.matchTable, table)
+	return schemaMatched && tableMatched
+}
+
+// MatchColumn column matches any of columns patterns
+func (mct *MaskColumnTrans) MatchColumn(column string) bool {
+	for _, pattern := range mct.columns {
+		if matched, _ := path.Match(pattern, column); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Transform mask matched columns of data and old row images, hash and format-preserve are deterministic,
+// a masked key still identifies rows
+func (mct *MaskColumnTrans) Transform(msg *core.Msg) bool {
+	if msg.Type != core.MsgDML {
+		return false
+	}
+	tableKey := msg.Database + "." + msg.Table
+	matched, ok := mct.tables[tableKey]
+	if !ok {
+		matched = mct.MatchTable(msg.Database, msg.Table)
+		mct.tables[tableKey] = matched
+		mct.tableColumns[tableKey] = make(map[string]bool)
+	}
+	if !matched {
+		return false
+	}
+	columns := mct.tableColumns[tableKey]
+	for _, row := range []map[string]interface{}{msg.DmlMsg.Data, msg.DmlMsg.Old} {
+		for column, value := range row {
+			matched, ok := columns[column]
+			if !ok {
+				matched = mct.MatchColumn(column)
+				columns[column] = matched
+			}
+			if matched && value != nil {
+				row[column] = mct.mask(value)
+			}
+		}
+	}
+	return false
+}
+
+func (mct *MaskColumnTrans) mask(value interface{}) interface{} {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	switch mct.strategy {
+	case MaskStrategyHash:
+		h := sha256.Sum256([]byte(mct.salt + s))
+		return hex.EncodeToString(h[:])
+	case MaskStrategyKeep:
+		return mct.keep(s)
+	case MaskStrategyFormatPreserve:
+		return mct.formatPreserve(s)
+	}
+	return nil
+}
+
+// keep first and last chars, the whole value is masked if not longer than them
+func (mct *MaskColumnTrans) keep(s string) string {
+	runes := []rune(s)
+	if len(runes) <= mct.keepFirst+mct.keepLast {
+		return strings.Repeat(mct.maskChar, len(runes))
+	}
+	return string(runes[:mct.keepFirst]) +
+		strings.Repeat(mct.maskChar, len(runes)-mct.keepFirst-mct.keepLast) +
+		string(runes[len(runes)-mct.keepLast:])
+}
+
+// formatPreserve shift digits and ascii letters by a keystream of hmac sha256 of the value keyed by salt,
+// other chars (e.g. + - @ .) are kept
+func (mct *MaskColumnTrans) formatPreserve(s string) string {
+	mac := hmac.New(sha256.New, []byte(mct.salt))
+	mac.Write([]byte(s))
+	seed := mac.Sum(nil)
+	var keystream []byte
+	var sb strings.Builder
+	sb.Grow(len(s))
+	i := 0
+	for _, r := range s {
+		if i >= len(keystream) {
+			// expand keystream, block n is sha256 of seed and n
+			block := make([]byte, len(seed)+4)
+			copy(block, seed)
+			binary.BigEndian.PutUint32(block[len(seed):], uint32(len(keystream)/sha256.Size))
+			h := sha256.Sum256(block)
+			keystream = append(keystream, h[:]...)
+		}
+		k := int(keystream[i])
+		switch {
+		case r >= '0' && r <= '9':
+			r = '0' + rune((int(r-'0')+k)%10)
+			i++
+		case r >= 'a' && r <= 'z':
+			r = 'a' + rune((int(r-'a')+k)%26)
+			i++
+		case r >= 'A' && r <= 'Z':
+			r = 'A' + rune((int(r-'A')+k)%26)
+			i++
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/sqlpub/qin-cdc/core"
 	"github.com/sqlpub/qin-cdc/metas"
 	"github.com/sqlpub/qin-cdc/metrics"
+	"slices"
 )
 
 type MatcherTransforms []core.Transform
@@ -53,6 +54,114 @@ func NewMatcherTransforms(transConfigs []config.TransformConfig, routers *metas.
 			}
 			log.Infof("load transform: %s", DeleteColumnTransName)
 			matcher = append(matcher, dct)
+		case FilterRowTransName:
+			frt := &FilterRowTrans{}
+			if err := frt.NewTransform(tc.Config); err != nil {
+				log.Fatal(err)
+			}
+			// expression columns must be router mapper columns at this point of transforms
+			for _, router := range routers.Raws {
+				if router.SourceSchema == frt.matchSchema && router.SourceTable == frt.matchTable {
+					for _, column := range frt.expression.Columns() {
+						if !slices.Contains(router.ColumnsMapper.SourceColumns, column) {
+							log.Fatalf("transform %s expression %s column %s not found in %s.%s",
+								FilterRowTransName, frt.expression, column, router.SourceSchema, router.SourceTable)
+						}
+					}
+				}
+			}
+			log.Infof("load transform: %s", FilterRowTransName)
+			matcher = append(matcher, frt)
+		case AddColumnTransName:
+			act := &AddColumnTrans{}
+			if err := act.NewTransform(tc.Config); err != nil {
+				log.Fatal(err)
+			}
+			// add router mapper column name the target table has, expression columns must be router mapper columns
+			for _, router := range routers.Raws {
+				if router.SourceSchema == act.matchSchema && router.SourceTable == act.matchTable {
+					for i, column := range act.columns {
+						for _, exprColumn := range act.values[i].Columns() {
+							if !slices.Contains(router.ColumnsMapper.SourceColumns, exprColumn) && !slices.Contains(act.columns[:i], exprColumn) {
+								log.Fatalf("transform %s expression %s column %s not found in %s.%s",
+									AddColumnTransName, act.values[i], exprColumn, router.SourceSchema, router.SourceTable)
+							}
+						}
+						if !targetHasColumn(router, column) {
+							log.Warnf("transform %s column %s not found in %s.%s, will not be written",
+								AddColumnTransName, column, router.TargetSchema, router.TargetTable)
+							continue
+						}
+						if !slices.Contains(router.ColumnsMapper.SourceColumns, column) {
+							router.ColumnsMapper.SourceColumns = append(router.ColumnsMapper.SourceColumns, column)
+						}
+						if !act.values[i].RowOnly() && !slices.Contains(router.ColumnsMapper.MetaColumns, column) {
+							// old row image leaves it out, stored value is of the event that wrote the row
+							router.ColumnsMapper.MetaColumns = append(router.ColumnsMapper.MetaColumns, column)
+						}
+					}
+				}
+			}
+			log.Infof("load transform: %s", AddColumnTransName)
+			matcher = append(matcher, act)
+		case MaskColumnTransName:
+			mct := &MaskColumnTrans{}
+			if err := mct.NewTransform(tc.Config); err != nil {
+				log.Fatal(err)
+			}
+			// masked key identifies rows only if masking keeps values distinct
+			for _, router := range routers.Raws {
+				if mct.MatchTable(router.SourceSchema, router.SourceTable) {
+					for _, pk := range router.ColumnsMapper.RowKeys {
+						if mct.MatchColumn(pk) && (mct.strategy == MaskStrategyKeep || mct.strategy == MaskStrategyNull) {
+							log.Warnf("transform %s strategy %s masks key column %s of %s.%s, rows may not be identified",
+								MaskColumnTransName, mct.strategy, pk, router.SourceSchema, router.SourceTable)
+						}
+					}
+				}
+			}
+			log.Infof("load transform: %s", MaskColumnTransName)
+			matcher = append(matcher, mct)
+		case CastColumnTransName:
+			cct := &CastColumnTrans{}
+			if err := cct.NewTransform(tc.Config); err != nil {
+				log.Fatal(err)
+			}
+			// cast columns must be router mapper columns at this point of transforms
+			for _, router := range routers.Raws {
+				if router.SourceSchema == cct.matchSchema && router.SourceTable == cct.matchTable {
+					for _, column := range cct.columns {
+						if !slices.Contains(router.ColumnsMapper.SourceColumns, column) {
+							log.Fatalf("transform %s column %s not found in %s.%s",
+								CastColumnTransName, column, router.SourceSchema, router.SourceTable)
+						}
+					}
+				}
+			}
+			log.Infof("load transform: %s", CastColumnTransName)
+			matcher = append(matcher, cct)
+		case FilterActionTransName:
+			fat := &FilterActionTrans{}
+			if err := fat.NewTransform(tc.Config); err != nil {
+				log.Fatal(err)
+			}
+			// add router mapper soft delete columns the target table has, outputs load all source columns
+			for _, router := range routers.Raws {
+				if router.SourceSchema == fat.matchSchema && router.SourceTable == fat.matchTable {
+					for _, column := range fat.SoftDeleteColumns() {
+						if !targetHasColumn(router, column) {
+							log.Warnf("transform %s soft delete column %s not found in %s.%s, will not be written",
+								FilterActionTransName, column, router.TargetSchema, router.TargetTable)
+							continue
+						}
+						if !slices.Contains(router.ColumnsMapper.SourceColumns, column) {
+							router.ColumnsMapper.SourceColumns = append(router.ColumnsMapper.SourceColumns, column)
+						}
+					}
+				}
+			}
+			log.Infof("load transform: %s", FilterActionTransName)
+			matcher = append(matcher, fat)
 		default:
 			log.Warnf("transform: %s unhandled will not take effect", typ)
 		}
@@ -60,6 +169,11 @@ func NewMatcherTransforms(transConfigs []config.TransformConfig, routers *metas.
 	return matcher
 }
 
+// targetHasColumn column is written to the target, outputs without table meta write all row columns
+func targetHasColumn(router *metas.Router, column string) bool {
+	return router.ColumnsMapper.SourceAsTarget || slices.Contains(router.ColumnsMapper.TargetColumns, column)
+}
+
 func (m MatcherTransforms) IterateTransforms(msg *core.Msg) bool {
 	for _, trans := range m {
 		if trans.Transform(msg) {
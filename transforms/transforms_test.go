@@ -0,0 +1,73 @@
+package transforms
+
+import (
+	"github.com/sqlpub/qin-cdc/config"
+	"github.com/sqlpub/qin-cdc/metas"
+	"slices"
+	"testing"
+)
+
+func TestSoftDeleteColumnsOnlyInTarget(t *testing.T) {
+	router := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t"}
+	router.ColumnsMapper.SourceColumns = []string{"id", "v"}
+	router.ColumnsMapper.TargetColumns = []string{"id", "v", "is_deleted"}
+	routers := &metas.Routers{Raws: []*metas.Router{router}}
+	NewMatcherTransforms([]config.TransformConfig{{Type: FilterActionTransName, Config: map[string]interface{}{
+		"match-schema": "db", "match-table": "t", "soft-delete": true,
+	}}}, routers)
+	// deleted_at is not in target, loads must not name it in columns
+	if !slices.Equal(router.ColumnsMapper.SourceColumns, []string{"id", "v", "is_deleted"}) {
+		t.Errorf("source columns = %v", router.ColumnsMapper.SourceColumns)
+	}
+	// output without table meta writes all row columns
+	router.ColumnsMapper.SourceColumns = []string{"id", "v"}
+	router.ColumnsMapper.TargetColumns = []string{"id", "v"}
+	router.ColumnsMapper.SourceAsTarget = true
+	NewMatcherTransforms([]config.TransformConfig{{Type: FilterActionTransName, Config: map[string]interface{}{
+		"match-schema": "db", "match-table": "t", "soft-delete": true,
+	}}}, routers)
+	if !slices.Equal(router.ColumnsMapper.SourceColumns, []string{"id", "v", "is_deleted", "deleted_at"}) {
+		t.Errorf("source as target columns = %v", router.ColumnsMapper.SourceColumns)
+	}
+}
+
+func TestAddColumnMetaColumns(t *testing.T) {
+	router := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t"}
+	router.ColumnsMapper.SourceColumns = []string{"id", "v"}
+	router.ColumnsMapper.TargetColumns = []string{"id", "v", "src", "op", "v2"}
+	routers := &metas.Routers{Raws: []*metas.Router{router}}
+	NewMatcherTransforms([]config.TransformConfig{{Type: AddColumnTransName, Config: map[string]interface{}{
+		"match-schema": "db", "match-table": "t",
+		"columns": []interface{}{"src", "op", "v2"}, "values": []interface{}{"'mysql'", "_op", "concat(v, _gtid)"},
+	}}}, routers)
+	if !slices.Equal(router.ColumnsMapper.SourceColumns, []string{"id", "v", "src", "op", "v2"}) {
+		t.Errorf("source columns = %v", router.ColumnsMapper.SourceColumns)
+	}
+	// values of event metadata are not part of the row image
+	if !slices.Equal(router.ColumnsMapper.MetaColumns, []string{"op", "v2"}) {
+		t.Errorf("meta columns = %v", router.ColumnsMapper.MetaColumns)
+	}
+}
+
+func TestAddColumnOnlyInTarget(t *testing.T) {
+	router := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t"}
+	router.ColumnsMapper.SourceColumns = []string{"id", "v"}
+	router.ColumnsMapper.TargetColumns = []string{"id", "v", "v2"}
+	kafkaRouter := &metas.Router{SourceSchema: "db", SourceTable: "t", TargetSchema: "db", TargetTable: "t"}
+	kafkaRouter.ColumnsMapper.SourceColumns = []string{"id", "v"}
+	kafkaRouter.ColumnsMapper.TargetColumns = []string{"id", "v"}
+	kafkaRouter.ColumnsMapper.SourceAsTarget = true
+	routers := &metas.Routers{Raws: []*metas.Router{router, kafkaRouter}}
+	NewMatcherTransforms([]config.TransformConfig{{Type: AddColumnTransName, Config: map[string]interface{}{
+		"match-schema": "db", "match-table": "t",
+		"columns": []interface{}{"tmp", "v2"}, "values": []interface{}{"upper(v)", "concat(tmp, id)"},
+	}}}, routers)
+	// tmp is not in target, not written, later columns may still use it
+	if !slices.Equal(router.ColumnsMapper.SourceColumns, []string{"id", "v", "v2"}) {
+		t.Errorf("source columns = %v", router.ColumnsMapper.SourceColumns)
+	}
+	// output without table meta writes all row columns
+	if !slices.Equal(kafkaRouter.ColumnsMapper.SourceColumns, []string{"id", "v", "tmp", "v2"}) {
+		t.Errorf("kafka source columns = %v", kafkaRouter.ColumnsMapper.SourceColumns)
+	}
+}
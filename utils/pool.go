@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+)
+
+// RunTasks run tasks with at most workers goroutines, wait for all of them, errors of all failed tasks are joined
+func RunTasks(workers int, tasks []func() error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	errs := make([]error, len(tasks))
+	for i, task := range tasks {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			errs[i] = task()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}